@@ -1 +1 @@
-go build -o app.exe src/main.go && app.exe
\ No newline at end of file
+go build -o app.exe ./src && app.exe
\ No newline at end of file
@@ -1,4 +1,4 @@
-go build -ldflags "-s -w" -o .\release\app.exe src/main.go
+go build -ldflags "-s -w" -o .\release\app.exe ./src
 
 COPY README.md .\release
 COPY LICENSE .\release
@@ -23,8 +23,8 @@ else
 fi
 
 # Docker
-# - stop container
-docker stop ${ALIAS}
+# - stop container, giving the app time for graceful shutdown
+docker stop -t 45 ${ALIAS}
 docker rm ${ALIAS}
 
 # - remove old image (if there is any)
@@ -0,0 +1,175 @@
+// Package azure provides storage in Azure Blob containers
+package azure
+
+import (
+	"app/src/storage"
+	"app/src/utils"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	log "github.com/sirupsen/logrus"
+)
+
+// Client keeps objects as block blobs in a single container. Implements storage.Storage
+type Client struct {
+	container azblob.ContainerURL
+	tier      azblob.AccessTierType
+	blockSize int
+	buffers   int
+}
+
+// NewClient authenticates with shared key, or with SAS token when account key is empty
+func NewClient(conf utils.AzureConfig) (*Client, error) {
+	if conf.Container == "" {
+		return nil, errors.New("azure container is not set")
+	}
+
+	// Endpoint is only needed for emulators e.g. Azurite "http://127.0.0.1:10000/devstoreaccount1"
+	endpoint := conf.Endpoint
+	if endpoint == "" {
+		endpoint = "https://" + conf.AccountName + ".blob.core.windows.net/"
+	}
+	containerURL, err := url.Parse(strings.TrimSuffix(endpoint, "/") + "/" + conf.Container)
+	if err != nil {
+		return nil, err
+	}
+
+	var credential azblob.Credential
+	if conf.AccountKey != "" {
+		credential, err = azblob.NewSharedKeyCredential(conf.AccountName, conf.AccountKey)
+		if err != nil {
+			return nil, err
+		}
+	} else if conf.SASToken != "" {
+		credential = azblob.NewAnonymousCredential()
+		containerURL.RawQuery = strings.TrimPrefix(conf.SASToken, "?")
+	} else {
+		return nil, errors.New("set either azure account_key or sas_token")
+	}
+
+	// Access tier, empty keeps account default
+	var tier azblob.AccessTierType
+	switch strings.ToLower(conf.AccessTier) {
+	case "":
+		tier = azblob.AccessTierNone
+	case "hot":
+		tier = azblob.AccessTierHot
+	case "cool":
+		tier = azblob.AccessTierCool
+	case "archive":
+		tier = azblob.AccessTierArchive
+	default:
+		return nil, errors.New("unknown azure access_tier '" + conf.AccessTier + "'")
+	}
+
+	p := azblob.NewPipeline(credential, azblob.PipelineOptions{})
+
+	return &Client{
+		container: azblob.NewContainerURL(*containerURL, p),
+		tier:      tier,
+		blockSize: conf.BlockSize * 1024 * 1024,
+		buffers:   conf.Concurrency,
+	}, nil
+}
+
+// isNotFound checks storage error for missing blob
+func isNotFound(err error) bool {
+	var serr azblob.StorageError
+	if errors.As(err, &serr) {
+		return serr.ServiceCode() == azblob.ServiceCodeBlobNotFound || serr.Response().StatusCode == http.StatusNotFound
+	}
+	return false
+}
+
+// Put streams content to a block blob, large files are sent in blocks
+func (c *Client) Put(key string, content io.Reader) error {
+	return c.PutContext(context.Background(), key, content)
+}
+
+// PutContext streams content to the container, the upload stops if ctx is done. Blocks of incomplete upload are never
+// committed and Azure removes them on its own
+func (c *Client) PutContext(ctx context.Context, key string, content io.Reader) error {
+	blob := c.container.NewBlockBlobURL(key)
+
+	_, err := azblob.UploadStreamToBlockBlob(ctx, content, blob, azblob.UploadStreamToBlockBlobOptions{
+		BufferSize:     c.blockSize,
+		MaxBuffers:     c.buffers,
+		BlobAccessTier: c.tier,
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Info("[azure.go][Put] Successfully uploaded key " + key)
+	return nil
+}
+
+// Stat returns object info, ErrNotFound if the key doesn't exist
+func (c *Client) Stat(key string) (storage.Object, error) {
+	props, err := c.container.NewBlobURL(key).GetProperties(context.Background(), azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		if isNotFound(err) {
+			return storage.Object{}, storage.ErrNotFound
+		}
+		return storage.Object{}, err
+	}
+
+	return storage.Object{
+		Key:          key,
+		Size:         props.ContentLength(),
+		LastModified: props.LastModified(),
+	}, nil
+}
+
+// List returns every blob stored under the given prefix
+func (c *Client) List(prefix string) ([]storage.Object, error) {
+	var objects []storage.Object
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		page, err := c.container.ListBlobsFlatSegment(context.Background(), marker, azblob.ListBlobsSegmentOptions{Prefix: prefix})
+		if err != nil {
+			return nil, err
+		}
+		for _, elem := range page.Segment.BlobItems {
+			var size int64
+			if elem.Properties.ContentLength != nil {
+				size = *elem.Properties.ContentLength
+			}
+			objects = append(objects, storage.Object{
+				Key:          elem.Name,
+				Size:         size,
+				LastModified: elem.Properties.LastModified,
+			})
+		}
+		marker = page.NextMarker
+	}
+
+	return objects, nil
+}
+
+// Get opens the blob for reading, caller must close it. Archived blobs must be rehydrated first
+func (c *Client) Get(key string) (io.ReadCloser, error) {
+	resp, err := c.container.NewBlobURL(key).Download(context.Background(), 0, azblob.CountToEnd, azblob.BlobAccessConditions{}, false, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		if isNotFound(err) {
+			return nil, storage.ErrNotFound
+		}
+		return nil, err
+	}
+
+	return resp.Body(azblob.RetryReaderOptions{MaxRetryRequests: 3}), nil
+}
+
+// Delete removes the blob together with its snapshots
+func (c *Client) Delete(key string) error {
+	_, err := c.container.NewBlobURL(key).Delete(context.Background(), azblob.DeleteSnapshotsOptionInclude, azblob.BlobAccessConditions{})
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+
+	return nil
+}
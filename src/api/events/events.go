@@ -0,0 +1,301 @@
+// Package events receives Kitsu event stream from its Socket.IO endpoint using Engine.IO v4 long-polling
+package events
+
+import (
+	"app/src/utils"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultNamespace is where Kitsu broadcasts its events
+const DefaultNamespace = "/events"
+
+// recordSeparator splits packets in a long-polling payload
+const recordSeparator = "\x1e"
+
+// Engine.IO packet types
+const (
+	packetOpen    = '0'
+	packetClose   = '1'
+	packetPing    = '2'
+	packetPong    = '3'
+	packetMessage = '4'
+	packetNoop    = '6'
+)
+
+// Socket.IO packet types carried by Engine.IO messages
+const (
+	socketConnect      = '0'
+	socketDisconnect   = '1'
+	socketEvent        = '2'
+	socketConnectError = '4'
+)
+
+var (
+	// errUnauthorized is Kitsu refusing the token, it's renewed before connecting again
+	errUnauthorized = errors.New("event stream refused the token")
+	// errDisconnected is the server leaving the namespace
+	errDisconnected = errors.New("disconnected from namespace")
+)
+
+// Event is a single event e.g. "comment:new" with its JSON payload
+type Event struct {
+	Name string
+	Data json.RawMessage
+}
+
+// Client listens to Kitsu event stream, reconnecting whenever the connection is lost
+type Client struct {
+	URL       string // Socket.IO endpoint e.g. "https://kitsu-example.com/socket.io/"
+	Namespace string
+	HTTP      *http.Client
+	Retry     utils.RetryConfig
+
+	// Token returns JWT token, stale is the token the stream has just refused
+	Token func(ctx context.Context, stale string) (string, error)
+}
+
+// handshake is the payload of Engine.IO open packet
+type handshake struct {
+	SID          string `json:"sid"`
+	PingInterval int    `json:"pingInterval"`
+	PingTimeout  int    `json:"pingTimeout"`
+}
+
+// NewClient creates client for Socket.IO endpoint
+func NewClient(endpoint string, retry utils.RetryConfig, token func(ctx context.Context, stale string) (string, error)) *Client {
+	return &Client{
+		URL:       endpoint,
+		Namespace: DefaultNamespace,
+		HTTP:      &http.Client{},
+		Retry:     retry,
+		Token:     token,
+	}
+}
+
+// Listen delivers events to handle one by one until ctx is done. Connection failures are logged and
+// followed by reconnecting with backoff
+func (c *Client) Listen(ctx context.Context, handle func(Event)) {
+	stale := ""
+	attempt := 0
+	for {
+		token, err := c.Token(ctx, stale)
+		stale = ""
+		if err == nil {
+			var connected bool
+			connected, err = c.session(ctx, token, handle)
+			if connected {
+				attempt = 0
+			}
+			if err == errUnauthorized {
+				stale = token
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		attempt++
+		delay := c.Retry.Backoff(attempt)
+		log.Warn("[events.go][Listen] Event stream lost: " + err.Error() + ", reconnecting in " + delay.Round(time.Millisecond).String())
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// session opens Engine.IO connection, joins the namespace and polls it until it fails. Tells if the namespace was joined
+func (c *Client) session(ctx context.Context, token string, handle func(Event)) (bool, error) {
+	// Open the connection
+	payload, err := c.poll(ctx, token, "", time.Minute)
+	if err != nil {
+		return false, err
+	}
+	if len(payload) == 0 || payload[0] != packetOpen {
+		return false, fmt.Errorf("unexpected handshake %q", utils.TruncateString(payload, 60))
+	}
+	var hs handshake
+	if err := json.Unmarshal([]byte(payload[1:]), &hs); err != nil {
+		return false, fmt.Errorf("handshake: %s", err.Error())
+	}
+
+	// Server pings every pingInterval, silence for longer than pingTimeout on top of that means the connection is dead
+	timeout := time.Duration(hs.PingInterval+hs.PingTimeout) * time.Millisecond
+	if timeout <= 0 {
+		timeout = time.Minute
+	}
+
+	// Join the namespace
+	if err := c.send(ctx, token, hs.SID, string(packetMessage)+string(socketConnect)+c.Namespace+","); err != nil {
+		return false, err
+	}
+
+	connected := false
+	for {
+		payload, err := c.poll(ctx, token, hs.SID, timeout)
+		if err != nil {
+			return connected, err
+		}
+
+		for _, packet := range strings.Split(payload, recordSeparator) {
+			if packet == "" {
+				continue
+			}
+			switch packet[0] {
+			case packetPing:
+				if err := c.send(ctx, token, hs.SID, string(packetPong)); err != nil {
+					return connected, err
+				}
+			case packetClose:
+				return connected, errors.New("closed by server")
+			case packetNoop, packetPong:
+			case packetMessage:
+				event, err := c.message(packet[1:])
+				if err == errUnauthorized || err == errDisconnected {
+					return connected, err
+				}
+				if err != nil {
+					log.Warn("[events.go][session] Skipping malformed packet: " + err.Error())
+					continue
+				}
+				if event == nil {
+					if !connected {
+						log.Info("[events.go][session] Subscribed to Kitsu events")
+					}
+					connected = true
+					continue
+				}
+				handle(*event)
+			}
+		}
+	}
+}
+
+// message parses Socket.IO packet of the namespace. Returns nil event for connect acknowledgement
+func (c *Client) message(packet string) (*Event, error) {
+	if packet == "" {
+		return nil, errors.New("empty packet")
+	}
+	kind := packet[0]
+	body := packet[1:]
+
+	// Packets of the default namespace have no prefix, others look like "/events,<data>"
+	namespace := "/"
+	if strings.HasPrefix(body, "/") {
+		ind := strings.Index(body, ",")
+		if ind < 0 {
+			namespace = body
+			body = ""
+		} else {
+			namespace = body[:ind]
+			body = body[ind+1:]
+		}
+	}
+	if namespace != c.Namespace {
+		return nil, fmt.Errorf("packet of namespace %s", namespace)
+	}
+
+	switch kind {
+	case socketConnect:
+		return nil, nil
+	case socketDisconnect:
+		return nil, errDisconnected
+	case socketConnectError:
+		log.Error("[events.go][message] Event stream refused connection: " + body)
+		return nil, errUnauthorized
+	case socketEvent:
+		// Acknowledgement ID goes before the data
+		body = strings.TrimLeft(body, "0123456789")
+
+		var args []json.RawMessage
+		if err := json.Unmarshal([]byte(body), &args); err != nil {
+			return nil, err
+		}
+		if len(args) == 0 {
+			return nil, errors.New("event without name")
+		}
+		event := Event{}
+		if err := json.Unmarshal(args[0], &event.Name); err != nil {
+			return nil, err
+		}
+		if len(args) > 1 {
+			event.Data = args[1]
+		}
+		return &event, nil
+	}
+
+	return nil, fmt.Errorf("unsupported packet type %q", kind)
+}
+
+// endpoint returns polling URL, sid is empty for the handshake
+func (c *Client) endpoint(sid string) string {
+	query := url.Values{}
+	query.Set("EIO", "4")
+	query.Set("transport", "polling")
+	query.Set("t", strconv.FormatInt(time.Now().UnixNano(), 36))
+	if sid != "" {
+		query.Set("sid", sid)
+	}
+	return c.URL + "?" + query.Encode()
+}
+
+// poll waits for packets from the server
+func (c *Client) poll(ctx context.Context, token, sid string, timeout time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.endpoint(sid), nil)
+	if err != nil {
+		return "", err
+	}
+	return c.do(req, token)
+}
+
+// send posts packet to the server
+func (c *Client) send(ctx context.Context, token, sid, packet string) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint(sid), strings.NewReader(packet))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain;charset=UTF-8")
+	_, err = c.do(req, token)
+	return err
+}
+
+func (c *Client) do(req *http.Request, token string) (string, error) {
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		return "", errUnauthorized
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", fmt.Errorf("%s %s: %s", req.Method, c.URL, resp.Status)
+	}
+
+	return string(body), nil
+}
@@ -0,0 +1,191 @@
+package events
+
+import (
+	"app/src/utils"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeServer is Socket.IO endpoint with a single session, polls of the session get queued payloads
+type fakeServer struct {
+	polls  chan string
+	refuse string // token answered with 401
+
+	mu     sync.Mutex
+	tokens []string // token of every request
+	sent   []string // packets posted by the client
+}
+
+func newFakeServer(payloads ...string) *fakeServer {
+	s := &fakeServer{polls: make(chan string, len(payloads))}
+	for _, elem := range payloads {
+		s.polls <- elem
+	}
+	return s
+}
+
+func (s *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if r.URL.Path != "/socket.io/" || query.Get("EIO") != "4" || query.Get("transport") != "polling" {
+		http.Error(w, "unexpected request "+r.URL.String(), http.StatusBadRequest)
+		return
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	s.mu.Lock()
+	s.tokens = append(s.tokens, token)
+	s.mu.Unlock()
+	if token == s.refuse {
+		http.Error(w, "token expired", http.StatusUnauthorized)
+		return
+	}
+
+	sid := query.Get("sid")
+	switch {
+	case sid == "":
+		w.Write([]byte(`0{"sid":"test","upgrades":["websocket"],"pingInterval":25000,"pingTimeout":20000}`))
+	case sid != "test":
+		http.Error(w, "unknown sid", http.StatusBadRequest)
+	case r.Method == http.MethodPost:
+		body, _ := ioutil.ReadAll(r.Body)
+		s.mu.Lock()
+		s.sent = append(s.sent, string(body))
+		s.mu.Unlock()
+		w.Write([]byte("ok"))
+	default:
+		select {
+		case payload := <-s.polls:
+			w.Write([]byte(payload))
+		case <-r.Context().Done():
+		}
+	}
+}
+
+// listen runs client against the server until handle has got count events
+func listen(t *testing.T, s *fakeServer, token func(ctx context.Context, stale string) (string, error), count int) []Event {
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var received []Event
+	client := NewClient(srv.URL+"/socket.io/", utils.RetryConfig{BaseDelay: 1, MaxDelay: 1}, token)
+	client.Listen(ctx, func(event Event) {
+		received = append(received, event)
+		if len(received) == count {
+			cancel()
+		}
+	})
+
+	if len(received) != count {
+		t.Fatalf("got %d events, want %d", len(received), count)
+	}
+	return received
+}
+
+func TestListen(t *testing.T) {
+	s := newFakeServer(
+		`40/events,{"sid":"socket"}`,
+		"2",
+		`42/events,["comment:new",{"comment_id":"c1","task_id":"t1"}]`+recordSeparator+`6`+recordSeparator+`42/events,["task:update",{"task_id":"t1"}]`,
+	)
+	token := func(ctx context.Context, stale string) (string, error) {
+		return "token", nil
+	}
+
+	received := listen(t, s, token, 2)
+
+	if received[0].Name != "comment:new" || string(received[0].Data) != `{"comment_id":"c1","task_id":"t1"}` {
+		t.Errorf("first event is %s %s", received[0].Name, received[0].Data)
+	}
+	if received[1].Name != "task:update" || string(received[1].Data) != `{"task_id":"t1"}` {
+		t.Errorf("second event is %s %s", received[1].Name, received[1].Data)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Namespace is joined first, ping is answered with pong
+	if strings.Join(s.sent, " ") != "40/events, 3" {
+		t.Errorf("client sent %q, want namespace connect and pong", s.sent)
+	}
+	for _, elem := range s.tokens {
+		if elem != "token" {
+			t.Errorf("request with token %q", elem)
+		}
+	}
+}
+
+func TestListenRenewsToken(t *testing.T) {
+	s := newFakeServer(
+		`40/events,{"sid":"socket"}`,
+		`42/events,["comment:new",{"comment_id":"c1"}]`,
+	)
+	s.refuse = "expired"
+
+	var stales []string
+	token := func(ctx context.Context, stale string) (string, error) {
+		stales = append(stales, stale)
+		if stale == "expired" {
+			return "renewed", nil
+		}
+		return "expired", nil
+	}
+
+	listen(t, s, token, 1)
+
+	if strings.Join(stales, ",") != ",expired" {
+		t.Errorf("token asked for with stale %q, want refused token passed once", stales)
+	}
+}
+
+func TestMessage(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet string
+		event  string // name and data of expected event, empty for none
+		err    error  // expected sentinel error
+		fails  bool
+	}{
+		{name: "connect", packet: `0/events,{"sid":"socket"}`},
+		{name: "connect without payload", packet: "0/events,"},
+		{name: "connect without comma", packet: "0/events"},
+		{name: "event", packet: `2/events,["comment:new",{"comment_id":"c1"}]`, event: `comment:new {"comment_id":"c1"}`},
+		{name: "event with ack id", packet: `2/events,12["comment:new",{"comment_id":"c1"}]`, event: `comment:new {"comment_id":"c1"}`},
+		{name: "event without data", packet: `2/events,["preview-file:update"]`, event: "preview-file:update "},
+		{name: "connect error", packet: `4/events,{"message":"Not authorized"}`, err: errUnauthorized},
+		{name: "disconnect", packet: "1/events,", err: errDisconnected},
+		{name: "default namespace", packet: `2["comment:new",{}]`, fails: true},
+		{name: "other namespace", packet: `2/chat,["comment:new",{}]`, fails: true},
+		{name: "event without name", packet: "2/events,[]", fails: true},
+		{name: "malformed event", packet: "2/events,{", fails: true},
+		{name: "unsupported type", packet: `3/events,["comment:new"]`, fails: true},
+		{name: "empty", packet: "", fails: true},
+	}
+
+	c := NewClient("", utils.RetryConfig{}, nil)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event, err := c.message(tt.packet)
+
+			switch {
+			case tt.err != nil || tt.fails:
+				if err == nil || (tt.err != nil && err != tt.err) {
+					t.Fatalf("message(%q) error %v, want %v", tt.packet, err, tt.err)
+				}
+			case err != nil:
+				t.Fatalf("message(%q) error %v", tt.packet, err)
+			case tt.event == "" && event != nil:
+				t.Fatalf("message(%q) = %s, want no event", tt.packet, event.Name)
+			case tt.event != "" && (event == nil || event.Name+" "+string(event.Data) != tt.event):
+				t.Fatalf("message(%q) = %+v, want %s", tt.packet, event, tt.event)
+			}
+		})
+	}
+}
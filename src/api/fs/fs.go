@@ -0,0 +1,141 @@
+// Package fs provides local filesystem storage, e.g. a mounted NAS share
+package fs
+
+import (
+	"app/src/storage"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Client keeps objects as plain files under the root dir. Implements storage.Storage
+type Client struct {
+	root string
+}
+
+// NewClient creates root dir if it's missing
+func NewClient(root string) (*Client, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+
+	return &Client{root: root}, nil
+}
+
+func (c *Client) localPath(key string) string {
+	return filepath.Join(c.root, filepath.FromSlash(key))
+}
+
+// Put writes content to a temp file first and moves it in place once complete
+func (c *Client) Put(key string, content io.Reader) error {
+	localPath := c.localPath(key)
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(localPath), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), localPath); err != nil {
+		return err
+	}
+
+	log.Info("[fs.go][Put] Successfully saved key " + key)
+	return nil
+}
+
+// Stat returns object info, ErrNotFound if the key doesn't exist
+func (c *Client) Stat(key string) (storage.Object, error) {
+	info, err := os.Stat(c.localPath(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return storage.Object{}, storage.ErrNotFound
+		}
+		return storage.Object{}, err
+	}
+
+	return storage.Object{
+		Key:          key,
+		Size:         info.Size(),
+		LastModified: info.ModTime(),
+	}, nil
+}
+
+// List returns every file stored under the given prefix
+func (c *Client) List(prefix string) ([]storage.Object, error) {
+	// Walk only the deepest dir covered by prefix
+	dir, _ := path.Split(prefix)
+	start := c.localPath(dir)
+
+	var objects []storage.Object
+	err := filepath.Walk(start, func(localPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".upload-") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(c.root, localPath)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		objects = append(objects, storage.Object{
+			Key:          key,
+			Size:         info.Size(),
+			LastModified: info.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return objects, nil
+}
+
+// Get opens the file for reading, caller must close it
+func (c *Client) Get(key string) (io.ReadCloser, error) {
+	f, err := os.Open(c.localPath(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, storage.ErrNotFound
+		}
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// Delete removes the file
+func (c *Client) Delete(key string) error {
+	err := os.Remove(c.localPath(key))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
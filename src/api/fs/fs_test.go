@@ -0,0 +1,117 @@
+package fs
+
+import (
+	"app/src/storage"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// failingReader returns some content and then fails as an interrupted download would
+type failingReader struct {
+	sent bool
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.sent {
+		return 0, errors.New("connection reset")
+	}
+	r.sent = true
+	return copy(p, "partial"), nil
+}
+
+func read(t *testing.T, c *Client, key string) string {
+	content, err := c.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer content.Close()
+	data, err := ioutil.ReadAll(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestClient(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "backup")
+	c, err := NewClient(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Put("project/shot/a.mov", strings.NewReader("first")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Put("project/shot/a.mov", strings.NewReader("second")); err != nil {
+		t.Fatalf("replacing existing object: %s", err)
+	}
+	if err := c.Put("project/b.png", strings.NewReader("image")); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := read(t, c, "project/shot/a.mov"); got != "second" {
+		t.Errorf("object holds %q", got)
+	}
+	object, err := c.Stat("project/shot/a.mov")
+	if err != nil || object.Size != 6 {
+		t.Errorf("Stat = %+v, %v", object, err)
+	}
+	if _, err := c.Stat("project/missing.mov"); err != storage.ErrNotFound {
+		t.Errorf("Stat of missing key: %v", err)
+	}
+	if _, err := c.Get("project/missing.mov"); err != storage.ErrNotFound {
+		t.Errorf("Get of missing key: %v", err)
+	}
+
+	objects, err := c.List("project/sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 1 || objects[0].Key != "project/shot/a.mov" {
+		t.Errorf("List = %+v", objects)
+	}
+	if objects, err := c.List("other/"); err != nil || len(objects) != 0 {
+		t.Errorf("List of missing dir = %+v, %v", objects, err)
+	}
+
+	if err := c.Delete("project/shot/a.mov"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "project", "shot", "a.mov")); !os.IsNotExist(err) {
+		t.Errorf("deleted file is still there: %v", err)
+	}
+	if err := c.Delete("project/shot/a.mov"); err != nil {
+		t.Errorf("deleting missing key: %s", err)
+	}
+}
+
+func TestClientFailedPut(t *testing.T) {
+	root := t.TempDir()
+	c, err := NewClient(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Put("project/a.mov", strings.NewReader("complete")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Put("project/a.mov", &failingReader{}); err == nil {
+		t.Fatal("Put succeeded on failing content")
+	}
+
+	// Existing object is left as it was and the temp file is cleaned up
+	if got := read(t, c, "project/a.mov"); got != "complete" {
+		t.Errorf("object holds %q", got)
+	}
+	files, err := ioutil.ReadDir(filepath.Join(root, "project"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("files left in dir: %v", files)
+	}
+}
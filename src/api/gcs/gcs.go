@@ -0,0 +1,146 @@
+// Package gcs provides storage in Google Cloud Storage buckets through the native API
+package gcs
+
+import (
+	"app/src/storage"
+	"app/src/utils"
+	"context"
+	"errors"
+	"io"
+
+	gcstorage "cloud.google.com/go/storage"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+// Client keeps objects in a single bucket. Implements storage.Storage
+type Client struct {
+	bucket       *gcstorage.BucketHandle
+	storageClass string
+	chunkSize    int
+}
+
+// NewClient authenticates with service account JSON credentials
+func NewClient(conf utils.GCSConfig) (*Client, error) {
+	if conf.Bucket == "" {
+		return nil, errors.New("gcs bucket is not set")
+	}
+
+	var opts []option.ClientOption
+	if conf.CredentialsFile != "" {
+		opts = append(opts, option.WithCredentialsFile(conf.CredentialsFile))
+	}
+	// Endpoint is only needed for emulators e.g. fake-gcs-server "http://127.0.0.1:4443/storage/v1/"
+	if conf.Endpoint != "" {
+		opts = append(opts, option.WithEndpoint(conf.Endpoint))
+		if conf.CredentialsFile == "" {
+			opts = append(opts, option.WithoutAuthentication())
+		}
+	}
+
+	client, err := gcstorage.NewClient(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{
+		bucket:       client.Bucket(conf.Bucket),
+		storageClass: conf.StorageClass,
+		chunkSize:    conf.ChunkSize * 1024 * 1024,
+	}, nil
+}
+
+// Put streams content to the bucket with resumable upload, large files are sent in chunks
+func (c *Client) Put(key string, content io.Reader) error {
+	return c.PutContext(context.Background(), key, content)
+}
+
+// PutContext streams content to the bucket, the upload is abandoned if ctx is done before it completes
+func (c *Client) PutContext(ctx context.Context, key string, content io.Reader) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	w := c.bucket.Object(key).NewWriter(ctx)
+	if c.storageClass != "" {
+		w.StorageClass = c.storageClass
+	}
+	if c.chunkSize > 0 {
+		w.ChunkSize = c.chunkSize
+	}
+
+	if _, err := io.Copy(w, content); err != nil {
+		// Cancelling context aborts the upload, Close is still needed to release the writer
+		cancel()
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	log.Info("[gcs.go][Put] Successfully uploaded key " + key)
+	return nil
+}
+
+// Stat returns object info, ErrNotFound if the key doesn't exist
+func (c *Client) Stat(key string) (storage.Object, error) {
+	attrs, err := c.bucket.Object(key).Attrs(context.Background())
+	if err != nil {
+		if errors.Is(err, gcstorage.ErrObjectNotExist) {
+			return storage.Object{}, storage.ErrNotFound
+		}
+		return storage.Object{}, err
+	}
+
+	return storage.Object{
+		Key:          key,
+		Size:         attrs.Size,
+		LastModified: attrs.Updated,
+	}, nil
+}
+
+// List returns every object stored under the given prefix
+func (c *Client) List(prefix string) ([]storage.Object, error) {
+	var objects []storage.Object
+	it := c.bucket.Objects(context.Background(), &gcstorage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, storage.Object{
+			Key:          attrs.Name,
+			Size:         attrs.Size,
+			LastModified: attrs.Updated,
+		})
+	}
+
+	return objects, nil
+}
+
+// Get opens the object for reading, caller must close it
+func (c *Client) Get(key string) (io.ReadCloser, error) {
+	r, err := c.bucket.Object(key).NewReader(context.Background())
+	if err != nil {
+		if errors.Is(err, gcstorage.ErrObjectNotExist) {
+			return nil, storage.ErrNotFound
+		}
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Delete removes the object
+func (c *Client) Delete(key string) error {
+	err := c.bucket.Object(key).Delete(context.Background())
+	if err != nil && !errors.Is(err, gcstorage.ErrObjectNotExist) {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,193 @@
+package kitsu
+
+import (
+	"app/src/utils"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// tokenLeeway is how long before expiry the token is renewed
+const tokenLeeway = time.Minute
+
+// tokens is Kitsu response to login and refresh requests
+type tokens struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// Token returns current JWT token
+func (c *Client) Token() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.token
+}
+
+func (c *Client) setTokens(t tokens) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.token = t.AccessToken
+	if t.RefreshToken != "" {
+		c.refreshToken = t.RefreshToken
+	}
+}
+
+// Login authenticates with email and password to get JWT token, credentials are kept to log in again once the token can't be refreshed
+func (c *Client) Login(ctx context.Context, email, password string) error {
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+
+	c.mu.Lock()
+	c.email = email
+	c.password = password
+	c.mu.Unlock()
+
+	return c.login(ctx)
+}
+
+func (c *Client) login(ctx context.Context) error {
+	type Payload struct {
+		Email    string `json:"email,omitempty"`
+		Password string `json:"password,omitempty"`
+	}
+
+	c.mu.RLock()
+	payload, err := json.Marshal(&Payload{Email: c.email, Password: c.password})
+	c.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	var t tokens
+	if err := c.authJSON(ctx, http.MethodPost, "api/auth/login", payload, "", &t); err != nil {
+		return err
+	}
+	if t.AccessToken == "" {
+		return errors.New("kitsu login: no access token in response")
+	}
+
+	c.setTokens(t)
+	return nil
+}
+
+// refresh exchanges refresh token for a new JWT token
+func (c *Client) refresh(ctx context.Context) error {
+	c.mu.RLock()
+	refreshToken := c.refreshToken
+	c.mu.RUnlock()
+	if refreshToken == "" {
+		return errors.New("kitsu refresh: no refresh token")
+	}
+
+	var t tokens
+	if err := c.authJSON(ctx, http.MethodGet, "api/auth/refresh-token", nil, refreshToken, &t); err != nil {
+		return err
+	}
+	if t.AccessToken == "" {
+		return errors.New("kitsu refresh: no access token in response")
+	}
+
+	c.setTokens(t)
+	return nil
+}
+
+// renewToken replaces stale token using refresh token and falls back to logging in again.
+// Does nothing if another request has already renewed it
+func (c *Client) renewToken(ctx context.Context, stale string) error {
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+
+	if c.Token() != stale {
+		return nil
+	}
+
+	err := c.refresh(ctx)
+	if err == nil {
+		log.Info("[auth.go][renewToken] JWT token refreshed")
+		return nil
+	}
+	log.Warn("[auth.go][renewToken] Failed to refresh JWT token, logging in again: " + err.Error())
+
+	if err := c.login(ctx); err != nil {
+		return err
+	}
+	log.Info("[auth.go][renewToken] JWT token acquired")
+	return nil
+}
+
+// FreshToken returns JWT token for connections made outside the client e.g. the event stream. Token is renewed
+// when it's about to expire or stale is the current one, pass the token the server has rejected
+func (c *Client) FreshToken(ctx context.Context, stale string) (string, error) {
+	token := c.Token()
+	if token != "" && (token == stale || tokenExpiresSoon(token)) {
+		if err := c.renewToken(ctx, token); err != nil {
+			return "", err
+		}
+		token = c.Token()
+	}
+	return token, nil
+}
+
+// authJSON sends auth request with explicit token, bypassing token renewal in do
+func (c *Client) authJSON(ctx context.Context, method, path string, body []byte, token string, out interface{}) error {
+	var respBody []byte
+	err := utils.Retry(ctx, c.Retry, c.retryable, func() error {
+		ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+
+		var reqBody io.Reader
+		if body != nil {
+			reqBody = bytes.NewReader(body)
+		}
+		req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, reqBody)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := c.send(req, path, token)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		respBody, err = ioutil.ReadAll(resp.Body)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(respBody, out)
+}
+
+// tokenExpiresSoon reads exp claim of JWT token, signature is not verified as the token came from Kitsu itself
+func tokenExpiresSoon(token string) bool {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return false
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return false
+	}
+
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp == 0 {
+		return false
+	}
+
+	return time.Until(time.Unix(claims.Exp, 0)) < tokenLeeway
+}
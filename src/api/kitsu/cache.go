@@ -0,0 +1,270 @@
+package kitsu
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// CacheEntry is a Kitsu object kept by the metadata cache, keyed by its API path
+type CacheEntry struct {
+	Path      string
+	UpdatedAt string
+	Data      []byte
+	ExpiresAt time.Time
+}
+
+// CacheStats tells how well the metadata cache works
+type CacheStats struct {
+	Entries int
+	Hits    int64
+	Misses  int64
+	Changed int64
+}
+
+// cache keeps raw JSON of projects, entities, tasks and types. Entries expire after ttl, objects seen in
+// collections or events with another updated_at replace or drop cached ones
+type cache struct {
+	// counters go first to stay 64-bit aligned for atomic
+	hits    int64
+	misses  int64
+	changed int64
+
+	ttl     time.Duration
+	mu      sync.RWMutex
+	entries map[string]CacheEntry
+}
+
+// object holds fields every Kitsu object has
+type object struct {
+	ID        string `json:"id"`
+	UpdatedAt string `json:"updated_at"`
+}
+
+func newCache(ttl time.Duration) *cache {
+	return &cache{ttl: ttl, entries: map[string]CacheEntry{}}
+}
+
+// get returns cached object unless it's missing or expired, expired one is dropped
+func (c *cache) get(path string) ([]byte, bool) {
+	c.mu.RLock()
+	entry, ok := c.entries[path]
+	c.mu.RUnlock()
+
+	if ok && time.Now().After(entry.ExpiresAt) {
+		c.drop(path)
+		ok = false
+	}
+	if !ok {
+		atomic.AddInt64(&c.misses, 1)
+		return nil, false
+	}
+	atomic.AddInt64(&c.hits, 1)
+	return entry.Data, true
+}
+
+// put stores the object for another ttl
+func (c *cache) put(path, updatedAt string, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if entry, ok := c.entries[path]; ok && entry.UpdatedAt != updatedAt {
+		atomic.AddInt64(&c.changed, 1)
+	}
+	c.entries[path] = CacheEntry{Path: path, UpdatedAt: updatedAt, Data: data, ExpiresAt: time.Now().Add(c.ttl)}
+}
+
+func (c *cache) drop(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, path)
+}
+
+// prune drops expired entries
+func (c *cache) prune() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for path, elem := range c.entries {
+		if now.After(elem.ExpiresAt) {
+			delete(c.entries, path)
+		}
+	}
+}
+
+// cold tells if the collection was never loaded or has expired since. Loaded collections are
+// marked with an empty entry under their own path so the mark is persisted along with objects
+func (c *cache) cold(collection string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	entry, ok := c.entries[collection]
+	return !ok || time.Now().After(entry.ExpiresAt)
+}
+
+func (c *cache) warmed(collection string) {
+	c.put(collection, "", nil)
+}
+
+// getCached works as get for a single object, the object is taken from cache when there is one
+func (c *Client) getCached(ctx context.Context, path string, out interface{}) error {
+	if c.cache == nil {
+		return c.get(ctx, path, out)
+	}
+
+	data, ok := c.cache.get(path)
+	if !ok {
+		var err error
+		data, err = c.doRaw(ctx, http.MethodGet, path, nil)
+		if err != nil {
+			return err
+		}
+
+		var obj object
+		if err := json.Unmarshal(data, &obj); err != nil {
+			return err
+		}
+		c.cache.put(path, obj.UpdatedAt, data)
+	}
+
+	return json.Unmarshal(data, out)
+}
+
+// cacheList stores every object of the list under path prefix e.g. "api/data/projects/"
+func (c *Client) cacheList(prefix string, list []json.RawMessage) error {
+	for _, elem := range list {
+		var obj object
+		if err := json.Unmarshal(elem, &obj); err != nil {
+			return err
+		}
+		if obj.ID == "" {
+			continue
+		}
+		c.cache.put(prefix+obj.ID, obj.UpdatedAt, elem)
+	}
+	return nil
+}
+
+// Invalidate drops cached object when updatedAt differs from the cached one e.g. on Kitsu event.
+// Empty updatedAt drops it anyway
+func (c *Client) Invalidate(kind, id, updatedAt string) {
+	if c.cache == nil {
+		return
+	}
+
+	path := "api/data/" + kind + "/" + id
+	c.cache.mu.RLock()
+	entry, ok := c.cache.entries[path]
+	c.cache.mu.RUnlock()
+
+	if ok && (updatedAt == "" || entry.UpdatedAt != updatedAt) {
+		atomic.AddInt64(&c.cache.changed, 1)
+		c.cache.drop(path)
+	}
+}
+
+// Prewarm fills the cache with projects, types, persons and entities using a few bulk requests instead of
+// a request per attachment. Only collections never loaded or expired are requested. Does nothing when cache is disabled
+func (c *Client) Prewarm(ctx context.Context) error {
+	if c.cache == nil {
+		return nil
+	}
+	c.cache.prune()
+
+	loaded := false
+	for _, path := range []string{"api/data/projects/", "api/data/task-types/", "api/data/entity-types/", "api/data/task-status/", "api/data/persons/"} {
+		if !c.cache.cold(path) {
+			continue
+		}
+		var list []json.RawMessage
+		if err := c.get(ctx, path, &list); err != nil {
+			return err
+		}
+		if err := c.cacheList(path, list); err != nil {
+			return err
+		}
+		c.cache.warmed(path)
+		loaded = true
+	}
+
+	// Entities include episodes and sequences as well, pager caches them
+	if c.cache.cold(entitiesPath) {
+		pager := c.EntityPager()
+		for {
+			var page []json.RawMessage
+			if !pager.Next(ctx, &page) {
+				break
+			}
+		}
+		if err := pager.Err(); err != nil {
+			return err
+		}
+		c.cache.warmed(entitiesPath)
+		loaded = true
+	}
+
+	if loaded {
+		log.Info("[cache.go][Prewarm] Kitsu cache holds " + strconv.Itoa(c.CacheStats().Entries) + " objects")
+	}
+	return nil
+}
+
+// CacheStats returns cache counters since the client was created
+func (c *Client) CacheStats() CacheStats {
+	if c.cache == nil {
+		return CacheStats{}
+	}
+
+	c.cache.mu.RLock()
+	entries := len(c.cache.entries)
+	c.cache.mu.RUnlock()
+
+	return CacheStats{
+		Entries: entries,
+		Hits:    atomic.LoadInt64(&c.cache.hits),
+		Misses:  atomic.LoadInt64(&c.cache.misses),
+		Changed: atomic.LoadInt64(&c.cache.changed),
+	}
+}
+
+// ExportCache returns entries which are not expired yet, to be persisted between runs
+func (c *Client) ExportCache() []CacheEntry {
+	if c.cache == nil {
+		return nil
+	}
+
+	c.cache.mu.RLock()
+	defer c.cache.mu.RUnlock()
+
+	now := time.Now()
+	var entries []CacheEntry
+	for _, elem := range c.cache.entries {
+		if now.Before(elem.ExpiresAt) {
+			entries = append(entries, elem)
+		}
+	}
+	return entries
+}
+
+// ImportCache loads persisted entries, expired ones are dropped
+func (c *Client) ImportCache(entries []CacheEntry) {
+	if c.cache == nil {
+		return
+	}
+
+	c.cache.mu.Lock()
+	defer c.cache.mu.Unlock()
+
+	now := time.Now()
+	for _, elem := range entries {
+		if now.Before(elem.ExpiresAt) {
+			c.cache.entries[elem.Path] = elem
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package kitsu
+
+import (
+	"app/src/utils"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultTimeout limits API requests when timeout is not set in config, file transfers are not limited
+const DefaultTimeout = 30 * time.Second
+
+// Client talks to Kitsu API on behalf of a single account, safe for concurrent use
+type Client struct {
+	BaseURL  string
+	HTTP     *http.Client
+	Timeout  time.Duration
+	PageSize int
+	Retry    utils.RetryConfig
+	Debug    bool
+
+	mu           sync.RWMutex
+	token        string
+	refreshToken string
+	email        string
+	password     string
+
+	// authMu makes concurrent requests wait for a single token renewal
+	authMu sync.Mutex
+
+	// cache keeps metadata lookups, nil when cache_ttl is not set
+	cache *cache
+}
+
+// APIError is returned when Kitsu responds with non successful status
+type APIError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Status     string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("kitsu %s %s: %s", e.Method, e.Path, e.Status)
+}
+
+// isUnauthorized tells if the error is Kitsu rejecting the token
+func isUnauthorized(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusUnauthorized
+}
+
+// retryable tells if the request may succeed next time: network failure or one of retryable statuses
+func (c *Client) retryable(err error) bool {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return c.Retry.IsRetryableStatus(apiErr.StatusCode)
+	}
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// retryableUnsent tells if a request which is not safe to repeat failed before reaching Kitsu, so it can't have taken effect
+func retryableUnsent(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// IsNotFound tells if the error is Kitsu responding with 404
+func IsNotFound(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+// NewClient creates client from config, call Login before any other request
+func NewClient(conf utils.Config) *Client {
+	timeout := time.Duration(conf.Kitsu.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	var metadata *cache
+	if conf.Kitsu.CacheTTL > 0 {
+		metadata = newCache(time.Duration(conf.Kitsu.CacheTTL) * time.Minute)
+	}
+
+	return &Client{
+		BaseURL: conf.Kitsu.Hostname,
+		HTTP: &http.Client{
+			Transport: &http.Transport{
+				Proxy: http.ProxyFromEnvironment,
+				DialContext: (&net.Dialer{
+					Timeout:   timeout,
+					KeepAlive: 30 * time.Second,
+				}).DialContext,
+				MaxIdleConnsPerHost:   16,
+				IdleConnTimeout:       90 * time.Second,
+				TLSHandshakeTimeout:   10 * time.Second,
+				ResponseHeaderTimeout: timeout,
+			},
+		},
+		Timeout:  timeout,
+		PageSize: conf.Kitsu.PageSize,
+		Retry:    conf.Retry,
+		Debug:    conf.Debug,
+		cache:    metadata,
+	}
+}
+
+// do sends request relative to BaseURL and checks response status, caller must close response body.
+// Token is renewed when it's about to expire, request is sent again once if Kitsu still responds with 401
+func (c *Client) do(ctx context.Context, method, path string, body io.Reader, contentType string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	token := c.Token()
+	if token != "" && tokenExpiresSoon(token) {
+		if err := c.renewToken(ctx, token); err != nil {
+			log.Warn("[client.go][do] Failed to renew JWT token ahead of expiry: " + err.Error())
+		}
+		token = c.Token()
+	}
+
+	resp, err := c.send(req, path, token)
+	if err == nil || !isUnauthorized(err) || token == "" {
+		return resp, err
+	}
+
+	// Streamed bodies are already consumed and can't be sent again
+	if body != nil && req.GetBody == nil {
+		return nil, err
+	}
+
+	log.Info("[client.go][do] JWT token rejected, renewing it")
+	if renewErr := c.renewToken(ctx, token); renewErr != nil {
+		return nil, fmt.Errorf("%s, token renewal failed: %s", err.Error(), renewErr.Error())
+	}
+
+	retry := req.Clone(ctx)
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	return c.send(retry, path, c.Token())
+}
+
+// send fetches request with the given token and turns non successful status into APIError
+func (c *Client) send(req *http.Request, path, token string) (*http.Response, error) {
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	// Fetch request
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check server response
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close()
+		return nil, &APIError{Method: req.Method, Path: path, StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	return resp, nil
+}
+
+// doJSON sends request and decodes JSON response into out. Each attempt is limited by Timeout, failed ones are retried
+func (c *Client) doJSON(ctx context.Context, method, path string, body []byte, out interface{}) error {
+	respBody, err := c.doRaw(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(respBody, out); err != nil {
+		return fmt.Errorf("kitsu %s %s: %s", method, path, err.Error())
+	}
+	return nil
+}
+
+// doRaw sends request the same way as doJSON and returns response body as it is. Only GET and HEAD are retried
+// on any failure, other methods may have taken effect already and are retried when the connection failed
+func (c *Client) doRaw(ctx context.Context, method, path string, body []byte) ([]byte, error) {
+	retryable := c.retryable
+	if method != http.MethodGet && method != http.MethodHead {
+		retryable = retryableUnsent
+	}
+
+	var respBody []byte
+	err := utils.Retry(ctx, c.Retry, retryable, func() error {
+		ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+
+		var reqBody io.Reader
+		if body != nil {
+			reqBody = bytes.NewReader(body)
+		}
+		resp, err := c.do(ctx, method, path, reqBody, "application/json")
+		if err != nil {
+			log.Warn("[client.go][doRaw] " + method + " " + path + " failed: " + err.Error())
+			return err
+		}
+		defer resp.Body.Close()
+
+		// Read response body
+		respBody, err = ioutil.ReadAll(resp.Body)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Debug {
+		log.Debug("[client.go][doRaw] " + method + " " + path + ": " + string(respBody))
+	}
+
+	return respBody, nil
+}
+
+// get fetches a single JSON document
+func (c *Client) get(ctx context.Context, path string, out interface{}) error {
+	return c.doJSON(ctx, http.MethodGet, path, nil, out)
+}
@@ -3,10 +3,14 @@ package kitsu
 
 import (
 	"app/src/utils"
-	"fmt"
+	"context"
+	"encoding/json"
 	"io"
+	"mime/multipart"
 	"net/http"
 	"os"
+
+	log "github.com/sirupsen/logrus"
 )
 
 type Task struct {
@@ -119,6 +123,9 @@ type Comment struct {
 	ObjectID  string      `json:"object_id,omitempty"`
 	PersonID  string      `json:"person_id,omitempty"`
 	Text      string      `json:"text,omitempty"`
+
+	// AttachmentFiles are IDs of attached files, filled when requested with relations
+	AttachmentFiles []string `json:"attachment_files,omitempty"`
 }
 
 type Comments struct {
@@ -173,204 +180,262 @@ type Attachments struct {
 	Each []Attachment
 }
 
-func GetComments() Comments {
-	path := utils.ConfRead().Kitsu.Hostname + "api/data/comments"
+func (c *Client) GetComments(ctx context.Context) (Comments, error) {
 	response := Comments{}
-	utils.Request(os.Getenv("KitsuJWTToken"), http.MethodGet, path, nil, &response.Each)
+	err := c.get(ctx, "api/data/comments", &response.Each)
 
-	return response
+	return response, err
 }
 
-func GetComment(objectID string) Comments {
-	path := utils.ConfRead().Kitsu.Hostname + "api/data/comments?object_id=" + objectID
+// GetComment returns comments of the object e.g. task
+func (c *Client) GetComment(ctx context.Context, objectID string) (Comments, error) {
 	response := Comments{}
-	utils.Request(os.Getenv("KitsuJWTToken"), http.MethodGet, path, nil, &response.Each)
+	err := c.get(ctx, "api/data/comments?object_id="+objectID, &response.Each)
+
+	return response, err
+}
+
+func (c *Client) GetCommentByID(ctx context.Context, commentID string) (Comment, error) {
+	response := Comment{}
+	err := c.get(ctx, "api/data/comments/"+commentID, &response)
 
-	return response
+	return response, err
 }
 
-func GetTasks() Tasks {
-	path := utils.ConfRead().Kitsu.Hostname + "api/data/tasks?relations=true"
+// CreateComment posts a new comment on the task keeping its current status
+func (c *Client) CreateComment(ctx context.Context, taskID, taskStatusID, text string) (Comment, error) {
+	response := Comment{}
+	body, err := json.Marshal(map[string]string{"task_status_id": taskStatusID, "comment": text})
+	if err != nil {
+		return response, err
+	}
+	err = c.doJSON(ctx, http.MethodPost, "api/actions/tasks/"+taskID+"/comment", body, &response)
+
+	return response, err
+}
+
+func (c *Client) GetTasks(ctx context.Context) (Tasks, error) {
 	response := Tasks{}
-	println(os.Getenv("KitsuJWTToken"))
-	utils.Request(os.Getenv("KitsuJWTToken"), http.MethodGet, path, nil, &response.Each)
+	pager := c.TaskPager()
+	for {
+		var page []Task
+		if !pager.Next(ctx, &page) {
+			break
+		}
+		response.Each = append(response.Each, page...)
+	}
 
-	return response
+	return response, pager.Err()
 }
 
-func GetTask(taskID string) Task {
-	path := utils.ConfRead().Kitsu.Hostname + "api/data/tasks/" + taskID
+func (c *Client) GetTask(ctx context.Context, taskID string) (Task, error) {
 	response := Task{}
-	utils.Request(os.Getenv("KitsuJWTToken"), http.MethodGet, path, nil, &response)
+	err := c.getCached(ctx, "api/data/tasks/"+taskID, &response)
 
-	return response
+	return response, err
 }
 
-func GetPerson(personID string) Person {
-	path := utils.ConfRead().Kitsu.Hostname + "api/data/persons/" + personID
+func (c *Client) GetPerson(ctx context.Context, personID string) (Person, error) {
 	response := Person{}
-	utils.Request(os.Getenv("KitsuJWTToken"), http.MethodGet, path, nil, &response)
+	err := c.getCached(ctx, "api/data/persons/"+personID, &response)
 
-	return response
+	return response, err
 }
 
-func GetPersons() Persons {
-	path := utils.ConfRead().Kitsu.Hostname + "api/data/persons/"
+func (c *Client) GetPersons(ctx context.Context) (Persons, error) {
 	response := Persons{}
-	utils.Request(os.Getenv("KitsuJWTToken"), http.MethodGet, path, nil, &response.Each)
+	err := c.get(ctx, "api/data/persons/", &response.Each)
 
-	return response
+	return response, err
 }
 
-func GetEntities() Entities {
-	path := utils.ConfRead().Kitsu.Hostname + "api/data/entities/"
+func (c *Client) GetEntities(ctx context.Context) (Entities, error) {
 	response := Entities{}
-	utils.Request(os.Getenv("KitsuJWTToken"), http.MethodGet, path, nil, &response.Each)
+	pager := c.EntityPager()
+	for {
+		var page []Entity
+		if !pager.Next(ctx, &page) {
+			break
+		}
+		response.Each = append(response.Each, page...)
+	}
 
-	return response
+	return response, pager.Err()
 }
 
-func GetEntity(EntityID string) Entity {
-	path := utils.ConfRead().Kitsu.Hostname + "api/data/entities/" + EntityID
+func (c *Client) GetEntity(ctx context.Context, entityID string) (Entity, error) {
 	response := Entity{}
-	utils.Request(os.Getenv("KitsuJWTToken"), http.MethodGet, path, nil, &response)
+	err := c.getCached(ctx, "api/data/entities/"+entityID, &response)
 
-	return response
+	return response, err
 }
 
-func GetEntityTypes() EntityTypes {
-	path := utils.ConfRead().Kitsu.Hostname + "api/data/entity-types/"
+func (c *Client) GetEntityTypes(ctx context.Context) (EntityTypes, error) {
 	response := EntityTypes{}
-	utils.Request(os.Getenv("KitsuJWTToken"), http.MethodGet, path, nil, &response.Each)
+	err := c.get(ctx, "api/data/entity-types/", &response.Each)
 
-	return response
+	return response, err
 }
 
-func GetEntityType(entityTypeID string) EntityType {
-	path := utils.ConfRead().Kitsu.Hostname + "api/data/entity-types/" + entityTypeID
+func (c *Client) GetEntityType(ctx context.Context, entityTypeID string) (EntityType, error) {
 	response := EntityType{}
-	utils.Request(os.Getenv("KitsuJWTToken"), http.MethodGet, path, nil, &response)
+	err := c.getCached(ctx, "api/data/entity-types/"+entityTypeID, &response)
 
-	return response
+	return response, err
 }
 
-func GetTaskStatuses() TaskStatuses {
-	path := utils.ConfRead().Kitsu.Hostname + "api/data/task-status/"
+func (c *Client) GetTaskStatuses(ctx context.Context) (TaskStatuses, error) {
 	response := TaskStatuses{}
-	utils.Request(os.Getenv("KitsuJWTToken"), http.MethodGet, path, nil, &response.Each)
+	err := c.get(ctx, "api/data/task-status/", &response.Each)
 
-	return response
+	return response, err
 }
 
-func GetTaskStatus(taskStatusID string) TaskStatus {
-	path := utils.ConfRead().Kitsu.Hostname + "api/data/task-status/" + taskStatusID
+func (c *Client) GetTaskStatus(ctx context.Context, taskStatusID string) (TaskStatus, error) {
 	response := TaskStatus{}
-	utils.Request(os.Getenv("KitsuJWTToken"), http.MethodGet, path, nil, &response)
+	err := c.getCached(ctx, "api/data/task-status/"+taskStatusID, &response)
 
-	return response
+	return response, err
 }
 
-func GetTaskType(taskID string) TaskType {
-	path := utils.ConfRead().Kitsu.Hostname + "api/data/task-types/" + taskID
+func (c *Client) GetTaskType(ctx context.Context, taskTypeID string) (TaskType, error) {
 	response := TaskType{}
-	utils.Request(os.Getenv("KitsuJWTToken"), http.MethodGet, path, nil, &response)
+	err := c.getCached(ctx, "api/data/task-types/"+taskTypeID, &response)
 
-	return response
+	return response, err
 }
 
-func GetTaskTypes() TaskTypes {
-	path := utils.ConfRead().Kitsu.Hostname + "api/data/task-types/"
+func (c *Client) GetTaskTypes(ctx context.Context) (TaskTypes, error) {
 	response := TaskTypes{}
-	utils.Request(os.Getenv("KitsuJWTToken"), http.MethodGet, path, nil, &response.Each)
+	err := c.get(ctx, "api/data/task-types/", &response.Each)
 
-	return response
+	return response, err
 }
 
-func GetProject(projectID string) Project {
-	path := utils.ConfRead().Kitsu.Hostname + "api/data/projects/" + projectID
+func (c *Client) GetProject(ctx context.Context, projectID string) (Project, error) {
 	response := Project{}
-	utils.Request(os.Getenv("KitsuJWTToken"), http.MethodGet, path, nil, &response)
+	err := c.getCached(ctx, "api/data/projects/"+projectID, &response)
 
-	return response
+	return response, err
 }
 
-func GetProjects() Projects {
-	path := utils.ConfRead().Kitsu.Hostname + "api/data/projects/"
+func (c *Client) GetProjects(ctx context.Context) (Projects, error) {
 	response := Projects{}
-	utils.Request(os.Getenv("KitsuJWTToken"), http.MethodGet, path, nil, &response.Each)
+	err := c.get(ctx, "api/data/projects/", &response.Each)
 
-	return response
+	return response, err
 }
 
-func GetProjectStatus(projectStatusID string) ProjectStatus {
-	path := utils.ConfRead().Kitsu.Hostname + "api/data/project-status/" + projectStatusID
+func (c *Client) GetProjectStatus(ctx context.Context, projectStatusID string) (ProjectStatus, error) {
 	response := ProjectStatus{}
-	utils.Request(os.Getenv("KitsuJWTToken"), http.MethodGet, path, nil, &response)
+	err := c.getCached(ctx, "api/data/project-status/"+projectStatusID, &response)
 
-	return response
+	return response, err
 }
 
-func GetAttachments() Attachments {
-	path := utils.ConfRead().Kitsu.Hostname + "api/data/attachment-files/"
+func (c *Client) GetAttachments(ctx context.Context) (Attachments, error) {
 	response := Attachments{}
-	utils.Request(os.Getenv("KitsuJWTToken"), http.MethodGet, path, nil, &response.Each)
-	return response
+	pager := c.AttachmentPager()
+	for {
+		var page []Attachment
+		if !pager.Next(ctx, &page) {
+			break
+		}
+		response.Each = append(response.Each, page...)
+	}
+
+	return response, pager.Err()
 }
 
-func GetAttachment(AttachmentID string) Attachment {
-	path := utils.ConfRead().Kitsu.Hostname + "api/data/attachment-files/" + AttachmentID
+func (c *Client) GetAttachment(ctx context.Context, attachmentID string) (Attachment, error) {
 	response := Attachment{}
-	utils.Request(os.Getenv("KitsuJWTToken"), http.MethodGet, path, nil, &response)
-	return response
+	err := c.get(ctx, "api/data/attachment-files/"+attachmentID, &response)
+
+	return response, err
 }
 
-func DownloadAttachment(localPath, id, filename string, conf utils.Config) (int64, error) {
+// DownloadAttachment saves the attachment file into localPath dir, interrupted downloads start over
+func (c *Client) DownloadAttachment(ctx context.Context, localPath, id, filename string) (int64, error) {
 	// Create dir
-	if _, err := os.Stat(localPath); os.IsNotExist(err) {
-		err := os.Mkdir(localPath, 0755)
+	if err := os.MkdirAll(localPath, 0755); err != nil {
+		return 0, err
+	}
+
+	var written int64
+	err := utils.Retry(ctx, c.Retry, c.retryable, func() error {
+		var err error
+		written, err = c.downloadOnce(ctx, localPath+"/"+filename, id, filename)
 		if err != nil {
-			panic(err)
+			log.Warn("[kitsu.go][DownloadAttachment] Failed to download attachment " + id + ": " + err.Error())
 		}
-	}
+		return err
+	})
 
-	// Create the file
-	out, err := os.Create(localPath + "/" + filename)
+	return written, err
+}
+
+func (c *Client) downloadOnce(ctx context.Context, filePath, id, filename string) (int64, error) {
+	// Make request
+	resp, err := c.do(ctx, http.MethodGet, "api/data/attachment-files/"+id+"/file/"+filename, nil, "application/json")
 	if err != nil {
-		panic(err)
+		return 0, err
 	}
-	defer out.Close()
+	defer resp.Body.Close()
 
-	// Make request
-	path := utils.ConfRead().Kitsu.Hostname + "api/data/attachment-files/" + id + "/file/" + filename
-	client := &http.Client{}
-	req, err := http.NewRequest(http.MethodGet, path, nil)
+	// Create the file
+	out, err := os.Create(filePath)
 	if err != nil {
-		panic(err)
+		return 0, err
 	}
+	defer out.Close()
 
-	// Set content type
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+os.Getenv("KitsuJWTToken"))
+	// Writer the body to file
+	return io.Copy(out, resp.Body)
+}
 
-	// Fetch request
-	resp, err := client.Do(req)
+// OpenAttachment returns the attachment file body as a stream, caller must close it.
+// Opening is retried, failures while reading the stream are up to the caller
+func (c *Client) OpenAttachment(ctx context.Context, id, filename string) (io.ReadCloser, error) {
+	var resp *http.Response
+	err := utils.Retry(ctx, c.Retry, c.retryable, func() error {
+		var err error
+		resp, err = c.do(ctx, http.MethodGet, "api/data/attachment-files/"+id+"/file/"+filename, nil, "application/json")
+		if err != nil {
+			log.Warn("[kitsu.go][OpenAttachment] Failed to open attachment " + id + ": " + err.Error())
+		}
+		return err
+	})
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	defer resp.Body.Close()
 
-	// Check server response
-	if resp.StatusCode != http.StatusOK {
-		//return fmt.Errorf("bad status: %s", resp.Status)
-		//panic("bad status:" + resp.Status)
-		return 0, fmt.Errorf(resp.Status)
-	}
+	return resp.Body, nil
+}
 
-	// Writer the body to file
-	size, err := io.Copy(out, resp.Body)
+// UploadAttachment attaches a file to an existing comment of the task. Content is streamed so the request is not retried
+func (c *Client) UploadAttachment(ctx context.Context, taskID, commentID, filename string, content io.Reader) error {
+	// Stream multipart body through a pipe so the file is never held in memory
+	bodyReader, bodyWriter := io.Pipe()
+	form := multipart.NewWriter(bodyWriter)
+	go func() {
+		part, err := form.CreateFormFile("file", filename)
+		if err != nil {
+			bodyWriter.CloseWithError(err)
+			return
+		}
+		if _, err := io.Copy(part, content); err != nil {
+			bodyWriter.CloseWithError(err)
+			return
+		}
+		bodyWriter.CloseWithError(form.Close())
+	}()
+
+	resp, err := c.do(ctx, http.MethodPost, "api/actions/tasks/"+taskID+"/comments/"+commentID+"/add-attachment", bodyReader, form.FormDataContentType())
 	if err != nil {
-		panic(err)
+		bodyReader.Close()
+		return err
 	}
+	resp.Body.Close()
 
-	return size, nil
+	return nil
 }
@@ -0,0 +1,71 @@
+package kitsu
+
+import (
+	"app/src/utils"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestUploadAttachment(t *testing.T) {
+	var method, path, filename, content string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path = r.Method, r.URL.Path
+
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		data, _ := ioutil.ReadAll(file)
+		filename, content = header.Filename, string(data)
+
+		w.Write([]byte(`[{"id":"a1"}]`))
+	}))
+	defer srv.Close()
+
+	conf := utils.Config{}
+	conf.Kitsu.Hostname = srv.URL + "/"
+	c := NewClient(conf)
+
+	err := c.UploadAttachment(context.Background(), "t1", "c1", "shot.mov", strings.NewReader("movie"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if method != http.MethodPost || path != "/api/actions/tasks/t1/comments/c1/add-attachment" {
+		t.Errorf("request is %s %s", method, path)
+	}
+	if filename != "shot.mov" || content != "movie" {
+		t.Errorf("file field holds %q with %q", filename, content)
+	}
+}
+
+func TestRetryOnlySafeMethods(t *testing.T) {
+	calls := map[string]int{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls[r.Method]++
+		http.Error(w, "busy", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	conf := utils.Config{}
+	conf.Kitsu.Hostname = srv.URL + "/"
+	conf.Retry = utils.RetryConfig{MaxAttempts: 3, BaseDelay: 1, MaxDelay: 1}
+	c := NewClient(conf)
+
+	if _, err := c.GetTask(context.Background(), "t1"); err == nil {
+		t.Fatal("GetTask succeeded on 503")
+	}
+	if _, err := c.CreateComment(context.Background(), "t1", "s1", "Restored from backup"); err == nil {
+		t.Fatal("CreateComment succeeded on 503")
+	}
+
+	if calls[http.MethodGet] != 3 || calls[http.MethodPost] != 1 {
+		t.Errorf("sent %d GET and %d POST requests, want 3 and 1", calls[http.MethodGet], calls[http.MethodPost])
+	}
+}
@@ -0,0 +1,139 @@
+package kitsu
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// DefaultPageSize is used when page_size is not set in config
+const DefaultPageSize = 500
+
+// sinceParam is the query filter asking Kitsu for objects with updated_at later than the given time. Kitsu versions
+// without it return the whole collection, callers must check updated_at of what they get
+const sinceParam = "updated_at_after"
+
+// Pager walks through a Kitsu collection page by page using "page" and "limit" query parameters
+type Pager struct {
+	client *Client
+	path   string
+	limit  int
+	page   int
+	done   bool
+	err    error
+
+	// cachePrefix is set for collections whose objects refresh the metadata cache e.g. "api/data/tasks/"
+	cachePrefix string
+}
+
+// paginatedResponse is what Kitsu returns for collections requested with "page" parameter
+type paginatedResponse struct {
+	Data    json.RawMessage `json:"data"`
+	Total   int             `json:"total"`
+	NbPages int             `json:"nb_pages"`
+	Page    int             `json:"page"`
+}
+
+// NewPager creates pager for a collection path relative to Kitsu hostname e.g. "api/data/tasks?relations=true"
+func (c *Client) NewPager(path string) *Pager {
+	limit := c.PageSize
+	if limit <= 0 {
+		limit = DefaultPageSize
+	}
+	return &Pager{client: c, path: path, limit: limit}
+}
+
+// AttachmentPager pages through all attachment files
+func (c *Client) AttachmentPager() *Pager {
+	return c.NewPager("api/data/attachment-files/")
+}
+
+// Cached collections
+const (
+	tasksPath    = "api/data/tasks/"
+	entitiesPath = "api/data/entities/"
+)
+
+// TaskPager pages through all tasks
+func (c *Client) TaskPager() *Pager {
+	pager := c.NewPager("api/data/tasks?relations=true")
+	pager.cachePrefix = tasksPath
+	return pager
+}
+
+// EntityPager pages through all entities
+func (c *Client) EntityPager() *Pager {
+	pager := c.NewPager(entitiesPath)
+	pager.cachePrefix = entitiesPath
+	return pager
+}
+
+// ChangedAttachmentPager pages through attachment files changed after since, a Kitsu timestamp
+func (c *Client) ChangedAttachmentPager(since string) *Pager {
+	return c.NewPager("api/data/attachment-files/?" + sinceParam + "=" + url.QueryEscape(since))
+}
+
+// ChangedCommentPager pages through comments changed after since along with their attachment IDs
+func (c *Client) ChangedCommentPager(since string) *Pager {
+	return c.NewPager("api/data/comments?relations=true&" + sinceParam + "=" + url.QueryEscape(since))
+}
+
+// ChangedTaskPager pages through tasks changed after since
+func (c *Client) ChangedTaskPager(since string) *Pager {
+	pager := c.NewPager("api/data/tasks?" + sinceParam + "=" + url.QueryEscape(since))
+	pager.cachePrefix = tasksPath
+	return pager
+}
+
+// Next fetches the next page into out, a pointer to slice. Returns false when there are no more pages
+// or the request failed, check Err afterwards
+func (p *Pager) Next(ctx context.Context, out interface{}) bool {
+	if p.done {
+		return false
+	}
+	p.page++
+
+	separator := "?"
+	if strings.Contains(p.path, "?") {
+		separator = "&"
+	}
+	path := p.path + separator + "page=" + strconv.Itoa(p.page) + "&limit=" + strconv.Itoa(p.limit)
+
+	response := paginatedResponse{}
+	if err := p.client.get(ctx, path, &response); err != nil {
+		p.err = err
+		p.done = true
+		return false
+	}
+
+	// Empty or missing data means we are past the last page
+	if len(response.Data) <= 2 {
+		p.done = true
+		return false
+	}
+	if err := json.Unmarshal(response.Data, out); err != nil {
+		p.err = err
+		p.done = true
+		return false
+	}
+
+	// Fresh objects replace cached ones with another updated_at
+	if p.cachePrefix != "" && p.client.cache != nil {
+		var list []json.RawMessage
+		if json.Unmarshal(response.Data, &list) == nil {
+			p.client.cacheList(p.cachePrefix, list)
+		}
+	}
+	if p.page >= response.NbPages {
+		p.done = true
+	}
+
+	return true
+}
+
+// Err returns the error which stopped the pager, nil when all pages were read
+func (p *Pager) Err() error {
+	return p.err
+}
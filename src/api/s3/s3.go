@@ -1,74 +1,274 @@
+// Package s3 provides methods for S3 compatible storages
 package s3
 
 import (
+	"app/src/storage"
 	"app/src/utils"
+	"context"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	log "github.com/sirupsen/logrus"
 )
 
-func UploadFile(filename string, content string, conf utils.Config) {
-	bucket := aws.String(conf.Backup.S3.BucketName)
-
-	key := aws.String(filename)
+// Client holds a single session to the bucket, safe for concurrent use. Implements storage.Storage
+type Client struct {
+	s3       *s3.S3
+	uploader *s3manager.Uploader
+	bucket   string
+}
 
+// NewClient creates S3 client from config, extra aws configs (custom HTTP client, retryer, logger etc.) are merged on top
+func NewClient(conf utils.S3Config, configs ...*aws.Config) (*Client, error) {
 	s3Config := &aws.Config{
-		Credentials:      credentials.NewStaticCredentials(conf.Backup.S3.AccessKey, conf.Backup.S3.SecretKey, ""),
-		Endpoint:         aws.String(conf.Backup.S3.Endpoint),
-		Region:           aws.String(conf.Backup.S3.Region),
-		S3ForcePathStyle: aws.Bool(conf.Backup.S3.S3ForcePathStyle),
+		Credentials:      credentials.NewStaticCredentials(conf.AccessKey, conf.SecretKey, ""),
+		Endpoint:         aws.String(conf.Endpoint),
+		Region:           aws.String(conf.Region),
+		S3ForcePathStyle: aws.Bool(conf.S3ForcePathStyle),
+		HTTPClient:       newHTTPClient(conf),
 	}
-	newSession, err := session.NewSession(s3Config)
+	newSession, err := session.NewSession(append([]*aws.Config{s3Config}, configs...)...)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	s3Client := s3.New(newSession)
+	uploader := s3manager.NewUploaderWithClient(s3Client, func(u *s3manager.Uploader) {
+		if conf.PartSize > 0 {
+			u.PartSize = int64(conf.PartSize) * 1024 * 1024
+		}
+		if conf.Concurrency > 0 {
+			u.Concurrency = conf.Concurrency
+		}
+	})
+
+	return &Client{
+		s3:       s3Client,
+		uploader: uploader,
+		bucket:   conf.BucketName,
+	}, nil
+}
+
+// retryer retries the statuses from retry policy on top of what aws retries by default (throttling like SlowDown, 5xx, network errors)
+type retryer struct {
+	client.DefaultRetryer
+	policy utils.RetryConfig
+}
 
-	_, err = s3Client.PutObject(&s3.PutObjectInput{
-		Body:   strings.NewReader(content),
-		Bucket: bucket,
-		Key:    key,
+func (r retryer) ShouldRetry(req *request.Request) bool {
+	if req.HTTPResponse != nil && r.policy.IsRetryableStatus(req.HTTPResponse.StatusCode) {
+		return true
+	}
+	return r.DefaultRetryer.ShouldRetry(req)
+}
+
+// WithRetry returns aws config applying retry policy to every request, pass it to NewClient
+func WithRetry(policy utils.RetryConfig) *aws.Config {
+	base, max := policy.Delays()
+
+	return request.WithRetryer(aws.NewConfig(), retryer{
+		DefaultRetryer: client.DefaultRetryer{
+			NumMaxRetries:    policy.Attempts() - 1,
+			MinRetryDelay:    base,
+			MaxRetryDelay:    max,
+			MinThrottleDelay: base,
+			MaxThrottleDelay: max,
+		},
+		policy: policy,
 	})
+}
 
+// newHTTPClient keeps enough idle connections to reuse them between uploads
+func newHTTPClient(conf utils.S3Config) *http.Client {
+	maxConns := conf.MaxConnections
+	if maxConns <= 0 {
+		maxConns = 32
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			MaxIdleConns:          maxConns,
+			MaxIdleConnsPerHost:   maxConns,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: 1 * time.Second,
+		},
+	}
+}
+
+// Put streams content to the bucket, large files are sent in parts
+func (c *Client) Put(key string, content io.Reader) error {
+	return c.PutContext(context.Background(), key, content)
+}
+
+// PutContext streams content to the bucket, multipart upload is aborted if ctx is done before it completes
+func (c *Client) PutContext(ctx context.Context, key string, content io.Reader) error {
+	_, err := c.uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Body:   content,
+		Bucket: aws.String(c.bucket),
+		Key:    aws.String(key),
+	})
 	if err != nil {
-		fmt.Printf("Failed to upload object %s%s, %s\n", *bucket, *key, err.Error())
-		return
+		// Uploader aborts with the same ctx, which fails once it's cancelled, so abort once more with a fresh one
+		if multiErr, ok := err.(s3manager.MultiUploadFailure); ok && multiErr.UploadID() != "" {
+			c.abortUpload(key, multiErr.UploadID())
+		}
+		return fmt.Errorf("failed to upload object %s/%s, %s", c.bucket, key, err.Error())
 	}
-	fmt.Printf("Successfully uploaded key %s\n", *key)
+
+	log.Info("[s3.go][Put] Successfully uploaded key " + key)
+	return nil
 }
 
-// not used
-func keyExists(bucket string, key string, conf utils.Config) (bool, error) {
-	s3Config := &aws.Config{
-		Credentials:      credentials.NewStaticCredentials(conf.Backup.S3.AccessKey, conf.Backup.S3.SecretKey, ""),
-		Endpoint:         aws.String(conf.Backup.S3.Endpoint),
-		Region:           aws.String(conf.Backup.S3.Region),
-		S3ForcePathStyle: aws.Bool(conf.Backup.S3.S3ForcePathStyle),
+// abortUpload removes parts of incomplete multipart upload so they don't take space in the bucket
+func (c *Client) abortUpload(key, uploadID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	_, err := c.s3.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(c.bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchUpload {
+			return
+		}
+		log.Warn("[s3.go][abortUpload] Failed to abort multipart upload of " + key + ": " + err.Error())
+		return
 	}
-	newSession := session.New(s3Config)
 
-	s3Client := s3.New(newSession)
+	log.Info("[s3.go][abortUpload] Aborted multipart upload of " + key)
+}
 
-	_, err := s3Client.HeadObject(&s3.HeadObjectInput{
-		Bucket: aws.String(bucket),
+// Stat returns object info, ErrNotFound if the key doesn't exist
+func (c *Client) Stat(key string) (storage.Object, error) {
+	out, err := c.s3.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(c.bucket),
 		Key:    aws.String(key),
 	})
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok {
 			switch aerr.Code() {
 			case "NotFound": // s3.ErrCodeNoSuchKey does not work, aws is missing this error code so we hardwire a string
-				return false, nil
+				return storage.Object{}, storage.ErrNotFound
 			default:
-				return false, err
+				return storage.Object{}, err
 			}
 		}
-		return false, err
+		return storage.Object{}, err
+	}
+
+	return storage.Object{
+		Key:          key,
+		Size:         aws.Int64Value(out.ContentLength),
+		LastModified: aws.TimeValue(out.LastModified),
+	}, nil
+}
+
+// List returns every object stored under the given prefix
+func (c *Client) List(prefix string) ([]storage.Object, error) {
+	var objects []storage.Object
+	err := c.s3.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(c.bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, elem := range page.Contents {
+			objects = append(objects, storage.Object{
+				Key:          aws.StringValue(elem.Key),
+				Size:         aws.Int64Value(elem.Size),
+				LastModified: aws.TimeValue(elem.LastModified),
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return objects, nil
+}
+
+// Get opens the object body for reading, caller must close it
+func (c *Client) Get(key string) (io.ReadCloser, error) {
+	out, err := c.s3.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(c.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+			return nil, storage.ErrNotFound
+		}
+		return nil, err
 	}
-	return true, nil
+
+	return out.Body, nil
+}
+
+// maxCopySize is the largest object CopyObject accepts
+const maxCopySize = 5 * 1024 * 1024 * 1024
+
+// Copy duplicates the object inside the bucket without downloading it, objects over 5 GB are streamed through
+func (c *Client) Copy(srcKey, dstKey string) error {
+	src, err := c.Stat(srcKey)
+	if err != nil {
+		return err
+	}
+	if src.Size > maxCopySize {
+		content, err := c.Get(srcKey)
+		if err != nil {
+			return err
+		}
+		defer content.Close()
+		return c.Put(dstKey, content)
+	}
+
+	_, err = c.s3.CopyObject(&s3.CopyObjectInput{
+		Bucket:     aws.String(c.bucket),
+		CopySource: aws.String(copySource(c.bucket, srcKey)),
+		Key:        aws.String(dstKey),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to copy object %s/%s to %s, %s", c.bucket, srcKey, dstKey, err.Error())
+	}
+
+	log.Info("[s3.go][Copy] Successfully copied key " + srcKey + " to " + dstKey)
+	return nil
+}
+
+// copySource URL-encodes "bucket/key" segment by segment, keeping slashes as is
+func copySource(bucket, key string) string {
+	segments := strings.Split(bucket+"/"+key, "/")
+	for i, elem := range segments {
+		segments[i] = url.PathEscape(elem)
+	}
+	return strings.Join(segments, "/")
+}
+
+// Delete removes the object from the bucket
+func (c *Client) Delete(key string) error {
+	_, err := c.s3.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(c.bucket),
+		Key:    aws.String(key),
+	})
+
+	return err
 }
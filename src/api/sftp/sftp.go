@@ -0,0 +1,324 @@
+// Package sftp provides storage on SFTP servers e.g. archival drop boxes
+package sftp
+
+import (
+	"app/src/storage"
+	"app/src/utils"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Client keeps objects as files under the remote root, reconnecting when the connection is lost. Implements storage.Storage
+type Client struct {
+	dial func() (*ssh.Client, error)
+	root string
+
+	mu   sync.Mutex
+	ssh  *ssh.Client
+	sftp *sftp.Client
+}
+
+// NewClient connects to the server with the private key from config. Server key is verified against
+// host_key or known_hosts, skipping verification has to be asked for with insecure_ignore_host_key
+func NewClient(conf utils.SFTPConfig) (*Client, error) {
+	if conf.KeyFile == "" {
+		return nil, errors.New("sftp key_file is not set")
+	}
+	key, err := ioutil.ReadFile(conf.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var hostKeyCallback ssh.HostKeyCallback
+	switch {
+	case conf.HostKey != "":
+		hostKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(conf.HostKey))
+		if err != nil {
+			return nil, fmt.Errorf("sftp host_key: %s", err.Error())
+		}
+		hostKeyCallback = ssh.FixedHostKey(hostKey)
+	case conf.KnownHosts != "":
+		hostKeyCallback, err = knownhosts.New(conf.KnownHosts)
+		if err != nil {
+			return nil, err
+		}
+	case conf.InsecureIgnoreHostKey:
+		log.Warn("[sftp.go][NewClient] insecure_ignore_host_key is set, server key is not verified")
+		hostKeyCallback = ssh.InsecureIgnoreHostKey()
+	default:
+		return nil, errors.New("sftp server key can't be verified, set known_hosts or host_key")
+	}
+
+	port := conf.Port
+	if port == 0 {
+		port = 22
+	}
+	addr := net.JoinHostPort(conf.Host, strconv.Itoa(port))
+	clientConfig := &ssh.ClientConfig{
+		User:            conf.User,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         30 * time.Second,
+	}
+
+	root := ""
+	if conf.RemoteRoot != "" {
+		root = path.Clean(conf.RemoteRoot)
+	}
+
+	c := &Client{
+		dial: func() (*ssh.Client, error) {
+			return ssh.Dial("tcp", addr, clientConfig)
+		},
+		root: root,
+	}
+	if _, err := c.reconnect(nil); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Close ends SFTP session and SSH connection
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.sftp == nil {
+		return nil
+	}
+	c.sftp.Close()
+	err := c.ssh.Close()
+	c.sftp, c.ssh = nil, nil
+	return err
+}
+
+// reconnect replaces the stale session with a new connection. Does nothing if another call has replaced it already
+func (c *Client) reconnect(stale *sftp.Client) (*sftp.Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.sftp != nil && c.sftp != stale {
+		return c.sftp, nil
+	}
+	// Connection goes first, closing the session alone would wait for a server which may never answer
+	if c.sftp != nil {
+		c.ssh.Close()
+		c.sftp.Close()
+		c.sftp, c.ssh = nil, nil
+	}
+
+	sshClient, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	sftpClient, err := sftp.NewClient(sshClient)
+	if err != nil {
+		sshClient.Close()
+		return nil, err
+	}
+	c.ssh, c.sftp = sshClient, sftpClient
+
+	if stale != nil {
+		log.Info("[sftp.go][reconnect] Reconnected to SFTP server")
+	}
+	return sftpClient, nil
+}
+
+// connectionLost tells if the error means the connection is gone rather than the operation failed
+func connectionLost(err error) bool {
+	return errors.Is(err, sftp.ErrSSHFxConnectionLost) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// do runs fn on the current session, once more on a new connection if the connection was lost.
+// fn must be safe to repeat
+func (c *Client) do(fn func(*sftp.Client) error) error {
+	c.mu.Lock()
+	client := c.sftp
+	c.mu.Unlock()
+
+	if client == nil {
+		var err error
+		if client, err = c.reconnect(nil); err != nil {
+			return err
+		}
+	}
+
+	err := fn(client)
+	if !connectionLost(err) {
+		return err
+	}
+
+	log.Warn("[sftp.go][do] Connection to SFTP server lost, reconnecting: " + err.Error())
+	client, err = c.reconnect(client)
+	if err != nil {
+		return err
+	}
+	return fn(client)
+}
+
+func (c *Client) remotePath(key string) string {
+	remotePath := path.Join(c.root, key)
+	if remotePath == "" {
+		return "."
+	}
+	return remotePath
+}
+
+// Put writes content to a temp file first and moves it in place once complete. Content can't be read twice,
+// the upload fails if the connection is lost while writing and the next call reconnects
+func (c *Client) Put(key string, content io.Reader) error {
+	remotePath := c.remotePath(key)
+	tmpPath := path.Join(path.Dir(remotePath), ".upload-"+path.Base(remotePath))
+
+	var client *sftp.Client
+	var tmp *sftp.File
+	err := c.do(func(s *sftp.Client) error {
+		if err := s.MkdirAll(path.Dir(remotePath)); err != nil {
+			return err
+		}
+		f, err := s.Create(tmpPath)
+		if err != nil {
+			return err
+		}
+		client, tmp = s, f
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.ReadFrom(content); err != nil {
+		tmp.Close()
+		client.Remove(tmpPath)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		client.Remove(tmpPath)
+		return err
+	}
+
+	// Plain rename fails on existing target with most servers
+	if err := client.PosixRename(tmpPath, remotePath); err != nil {
+		client.Remove(remotePath)
+		if err := client.Rename(tmpPath, remotePath); err != nil {
+			client.Remove(tmpPath)
+			return err
+		}
+	}
+
+	log.Info("[sftp.go][Put] Successfully uploaded key " + key)
+	return nil
+}
+
+// Stat returns object info, ErrNotFound if the key doesn't exist
+func (c *Client) Stat(key string) (storage.Object, error) {
+	var info os.FileInfo
+	err := c.do(func(s *sftp.Client) error {
+		var err error
+		info, err = s.Stat(c.remotePath(key))
+		return err
+	})
+	if err != nil {
+		if os.IsNotExist(err) {
+			return storage.Object{}, storage.ErrNotFound
+		}
+		return storage.Object{}, err
+	}
+
+	return storage.Object{
+		Key:          key,
+		Size:         info.Size(),
+		LastModified: info.ModTime(),
+	}, nil
+}
+
+// List returns every file stored under the given prefix
+func (c *Client) List(prefix string) ([]storage.Object, error) {
+	// Walk only the deepest dir covered by prefix
+	dir, _ := path.Split(prefix)
+
+	var objects []storage.Object
+	err := c.do(func(s *sftp.Client) error {
+		objects = nil
+		walker := s.Walk(c.remotePath(dir))
+		for walker.Step() {
+			if err := walker.Err(); err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return err
+			}
+
+			info := walker.Stat()
+			if info.IsDir() || strings.HasPrefix(info.Name(), ".upload-") {
+				continue
+			}
+
+			key := strings.TrimPrefix(walker.Path(), strings.TrimSuffix(c.root, "/")+"/")
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+
+			objects = append(objects, storage.Object{
+				Key:          key,
+				Size:         info.Size(),
+				LastModified: info.ModTime(),
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return objects, nil
+}
+
+// Get opens the remote file for reading, caller must close it
+func (c *Client) Get(key string) (io.ReadCloser, error) {
+	var f *sftp.File
+	err := c.do(func(s *sftp.Client) error {
+		var err error
+		f, err = s.Open(c.remotePath(key))
+		return err
+	})
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, storage.ErrNotFound
+		}
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// Delete removes the remote file
+func (c *Client) Delete(key string) error {
+	err := c.do(func(s *sftp.Client) error {
+		return s.Remove(c.remotePath(key))
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,298 @@
+package sftp
+
+import (
+	"app/src/storage"
+	"app/src/utils"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// testServer is SFTP server serving local filesystem, connections can be dropped to test reconnecting
+type testServer struct {
+	addr    string
+	port    int
+	hostKey ssh.Signer
+
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func newTestSigner(t *testing.T) (ssh.Signer, []byte) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+}
+
+func newTestServer(t *testing.T) *testServer {
+	hostKey, _ := newTestSigner(t)
+	conf := &ssh.ServerConfig{
+		PublicKeyCallback: func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+			return nil, nil
+		},
+	}
+	conf.AddHostKey(hostKey)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	s := &testServer{addr: ln.Addr().String(), port: ln.Addr().(*net.TCPAddr).Port, hostKey: hostKey}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns = append(s.conns, conn)
+			s.mu.Unlock()
+			go s.serve(conn, conf)
+		}
+	}()
+	t.Cleanup(s.drop)
+
+	return s
+}
+
+func (s *testServer) serve(conn net.Conn, conf *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, conf)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range requests {
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if ok {
+					server, err := sftp.NewServer(channel)
+					if err != nil {
+						return
+					}
+					go func() {
+						server.Serve()
+						channel.Close()
+					}()
+				}
+			}
+		}()
+	}
+}
+
+// drop closes every connection as a server restart or a network failure would
+func (s *testServer) drop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, elem := range s.conns {
+		elem.Close()
+	}
+	s.conns = nil
+}
+
+// config returns client settings for the server with the given root, host key is left to the caller
+func (s *testServer) config(t *testing.T) utils.SFTPConfig {
+	_, clientKey := newTestSigner(t)
+	keyFile := filepath.Join(t.TempDir(), "id_rsa")
+	if err := ioutil.WriteFile(keyFile, clientKey, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return utils.SFTPConfig{
+		Host:       "127.0.0.1",
+		Port:       s.port,
+		User:       "backup",
+		KeyFile:    keyFile,
+		RemoteRoot: t.TempDir(),
+	}
+}
+
+func (s *testServer) connect(t *testing.T) (*Client, string) {
+	conf := s.config(t)
+	conf.HostKey = string(ssh.MarshalAuthorizedKey(s.hostKey.PublicKey()))
+
+	c, err := NewClient(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c, conf.RemoteRoot
+}
+
+func read(t *testing.T, c *Client, key string) string {
+	content, err := c.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer content.Close()
+	data, err := ioutil.ReadAll(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestClient(t *testing.T) {
+	s := newTestServer(t)
+	c, root := s.connect(t)
+
+	if err := c.Put("project/shot/a.mov", strings.NewReader("first")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Put("project/shot/a.mov", strings.NewReader("second")); err != nil {
+		t.Fatalf("replacing existing object: %s", err)
+	}
+	if err := c.Put("project/b.png", strings.NewReader("image")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Temp files are moved in place
+	files, err := ioutil.ReadDir(filepath.Join(root, "project", "shot"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name() != "a.mov" {
+		t.Errorf("files left in dir: %v", files)
+	}
+
+	if got := read(t, c, "project/shot/a.mov"); got != "second" {
+		t.Errorf("object holds %q", got)
+	}
+	object, err := c.Stat("project/shot/a.mov")
+	if err != nil || object.Size != 6 {
+		t.Errorf("Stat = %+v, %v", object, err)
+	}
+	if _, err := c.Stat("project/missing.mov"); err != storage.ErrNotFound {
+		t.Errorf("Stat of missing key: %v", err)
+	}
+
+	objects, err := c.List("project/sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 1 || objects[0].Key != "project/shot/a.mov" {
+		t.Errorf("List = %+v", objects)
+	}
+	if objects, err := c.List("other/"); err != nil || len(objects) != 0 {
+		t.Errorf("List of missing dir = %+v, %v", objects, err)
+	}
+
+	if err := c.Delete("project/shot/a.mov"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "project", "shot", "a.mov")); !os.IsNotExist(err) {
+		t.Errorf("deleted file is still there: %v", err)
+	}
+	if err := c.Delete("project/shot/a.mov"); err != nil {
+		t.Errorf("deleting missing key: %s", err)
+	}
+}
+
+func TestClientReconnects(t *testing.T) {
+	s := newTestServer(t)
+	c, _ := s.connect(t)
+
+	if err := c.Put("a.mov", strings.NewReader("movie")); err != nil {
+		t.Fatal(err)
+	}
+
+	s.drop()
+	if object, err := c.Stat("a.mov"); err != nil || object.Size != 5 {
+		t.Fatalf("Stat after connection loss = %+v, %v", object, err)
+	}
+
+	s.drop()
+	if err := c.Put("b.mov", strings.NewReader("movie")); err != nil {
+		t.Fatalf("Put after connection loss: %s", err)
+	}
+
+	s.drop()
+	if objects, err := c.List(""); err != nil || len(objects) != 2 {
+		t.Fatalf("List after connection loss = %+v, %v", objects, err)
+	}
+
+	s.drop()
+	if got := read(t, c, "b.mov"); got != "movie" {
+		t.Errorf("object holds %q", got)
+	}
+}
+
+func TestClientHostKey(t *testing.T) {
+	s := newTestServer(t)
+	otherKey, _ := newTestSigner(t)
+
+	knownHosts := func(key ssh.PublicKey) string {
+		file := filepath.Join(t.TempDir(), "known_hosts")
+		if err := ioutil.WriteFile(file, []byte(knownhosts.Line([]string{s.addr}, key)+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+
+	tests := []struct {
+		name  string
+		setup func(*utils.SFTPConfig)
+		fails bool
+	}{
+		{name: "no verification", setup: func(*utils.SFTPConfig) {}, fails: true},
+		{name: "pinned key", setup: func(conf *utils.SFTPConfig) {
+			conf.HostKey = string(ssh.MarshalAuthorizedKey(s.hostKey.PublicKey()))
+		}},
+		{name: "other pinned key", setup: func(conf *utils.SFTPConfig) {
+			conf.HostKey = string(ssh.MarshalAuthorizedKey(otherKey.PublicKey()))
+		}, fails: true},
+		{name: "malformed pinned key", setup: func(conf *utils.SFTPConfig) {
+			conf.HostKey = "ssh-rsa AAAA"
+		}, fails: true},
+		{name: "known host", setup: func(conf *utils.SFTPConfig) {
+			conf.KnownHosts = knownHosts(s.hostKey.PublicKey())
+		}},
+		{name: "unknown host", setup: func(conf *utils.SFTPConfig) {
+			conf.KnownHosts = knownHosts(otherKey.PublicKey())
+		}, fails: true},
+		{name: "insecure opt-in", setup: func(conf *utils.SFTPConfig) {
+			conf.InsecureIgnoreHostKey = true
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := s.config(t)
+			tt.setup(&conf)
+
+			c, err := NewClient(conf)
+			if err == nil {
+				c.Close()
+			}
+			if tt.fails != (err != nil) {
+				t.Errorf("NewClient error %v, want failure %v", err, tt.fails)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"app/src/model"
+	"app/src/storage"
+	"app/src/utils"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// DefaultDeleteGracePeriod is used when delete_grace_period is not set, backups are never deleted right away unless fast_delete asks for it
+const DefaultDeleteGracePeriod = 72 * time.Hour
+
+// handleDeletedAttachments removes backups of attachments which are no longer in Kitsu,
+// right away with fast_delete or once delete_grace_period is over. Only attachments recorded before listedAt
+// are considered, those backed up meanwhile e.g. by live mode may be missing from the list
+func handleDeletedAttachments(conf utils.Config, db *gorm.DB, destinations []storage.Destination, kitsuIDs []string, listedAt time.Time) {
+	now := time.Now()
+	gracePeriod := time.Duration(conf.Backup.DeleteGracePeriod) * time.Hour
+	if gracePeriod <= 0 {
+		gracePeriod = DefaultDeleteGracePeriod
+	}
+
+	// Attachments which came back to Kitsu are kept
+	removed := model.FindAttachmentIDsByStatus(db, model.StatusRemoved)
+	for _, id := range utils.Difference(removed, utils.Difference(removed, kitsuIDs)) {
+		log.Info("[delete.go][handleDeletedAttachments] Attachment " + id + " is back in Kitsu, keeping it")
+		model.UnmarkAttachmentRemoved(db, id)
+	}
+
+	for _, id := range utils.Difference(model.FindKnownAttachmentIDs(db, listedAt), kitsuIDs) {
+		attachment := model.FindAttachment(db, id)
+
+		if !conf.Backup.FastDelete {
+			if attachment.RemovedAt == nil {
+				log.Info("[delete.go][handleDeletedAttachments] Attachment " + id + " was removed from Kitsu, deleting after grace period")
+				model.MarkAttachmentRemoved(db, id, now)
+				continue
+			}
+			if now.Sub(*attachment.RemovedAt) < gracePeriod {
+				continue
+			}
+		}
+
+		if purgeAttachment(db, destinations, attachment) {
+			model.MarkAttachmentPurged(db, id, now)
+			log.Info("[delete.go][handleDeletedAttachments] Deleted backups of attachment " + id)
+		}
+	}
+}
+
+// purgeAttachment deletes every copy of the attachment, returns false if some of them are left
+func purgeAttachment(db *gorm.DB, destinations []storage.Destination, attachment model.Attachment) bool {
+	uploads := model.FindUploads(db, attachment.AttachmentID)
+
+	ok := true
+	for _, dest := range destinations {
+		key := attachment.AttachmentKey
+		for _, elem := range uploads {
+			if elem.Destination == dest.Name && elem.AttachmentKey != "" {
+				key = elem.AttachmentKey
+			}
+		}
+		if key == "" {
+			continue
+		}
+
+		if err := dest.Delete(key); err != nil {
+			log.Error("[delete.go][purgeAttachment] Failed to delete '" + key + "' from '" + dest.Name + "': " + err.Error())
+			ok = false
+			continue
+		}
+		model.UpdateUploadStatus(db, attachment.AttachmentID, dest.Name, "deleted")
+	}
+
+	return ok
+}
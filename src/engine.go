@@ -0,0 +1,445 @@
+package main
+
+import (
+	"app/src/api/kitsu"
+	"app/src/layout"
+	"app/src/model"
+	"app/src/storage"
+	"app/src/utils"
+	"context"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// semaphore limits how many goroutines do the same kind of work at once
+type semaphore chan struct{}
+
+func newSemaphore(n int) semaphore {
+	return make(semaphore, n)
+}
+
+// acquire waits for a free slot, fails when ctx is done first
+func (s semaphore) acquire(ctx context.Context) error {
+	select {
+	case s <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s semaphore) release() {
+	<-s
+}
+
+// engine backs up attachments on a bounded pool of workers. Besides the number of workers
+// Kitsu metadata lookups, downloads and uploads have limits of their own
+type engine struct {
+	work         context.Context
+	conf         utils.Config
+	db           *gorm.DB
+	kc           *kitsu.Client
+	keys         *layout.Template
+	destinations []storage.Destination
+
+	// legacyKeys is the layout backups were made with before locations were recorded
+	legacyKeys *layout.Template
+
+	workers   int
+	metadata  semaphore
+	downloads semaphore
+	uploads   semaphore
+
+	// fullOnly is set once Kitsu turns out to ignore updated_at filter
+	fullOnly int32
+
+	// inflight holds attachments being backed up, scans and live events may come across the same one
+	mu       sync.Mutex
+	inflight map[string]bool
+}
+
+// newEngine creates engine, cancelling work aborts Kitsu requests and transfers in progress
+func newEngine(work context.Context, conf utils.Config, db *gorm.DB, kc *kitsu.Client, keys *layout.Template, destinations []storage.Destination) *engine {
+	limits := conf.Backup.Workers
+
+	// Legacy threads setting: 0 is sequential, below 0 was unbounded
+	workers := limits.Attachments
+	if workers <= 0 {
+		switch {
+		case conf.Backup.Threads > 0:
+			workers = conf.Backup.Threads
+		case conf.Backup.Threads < 0:
+			workers = 16
+		default:
+			workers = 1
+		}
+	}
+
+	limit := func(n int) int {
+		if n <= 0 {
+			return workers
+		}
+		return n
+	}
+
+	legacyKeys, err := layout.New(layout.DefaultTemplate)
+	if err != nil {
+		panic(err)
+	}
+
+	log.Info("[engine.go][newEngine] Workers: " + strconv.Itoa(workers) +
+		", metadata: " + strconv.Itoa(limit(limits.Metadata)) +
+		", downloads: " + strconv.Itoa(limit(limits.Downloads)) +
+		", uploads: " + strconv.Itoa(limit(limits.Uploads)))
+
+	return &engine{
+		work:         work,
+		conf:         conf,
+		db:           db,
+		kc:           kc,
+		keys:         keys,
+		legacyKeys:   legacyKeys,
+		destinations: destinations,
+		workers:      workers,
+		metadata:     newSemaphore(limit(limits.Metadata)),
+		downloads:    newSemaphore(limit(limits.Downloads)),
+		uploads:      newSemaphore(limit(limits.Uploads)),
+		inflight:     map[string]bool{},
+	}
+}
+
+// claim marks the attachment as being backed up, false when someone else is on it already
+func (e *engine) claim(attachmentID string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.inflight[attachmentID] {
+		return false
+	}
+	e.inflight[attachmentID] = true
+	return true
+}
+
+func (e *engine) unclaim(attachmentID string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.inflight, attachmentID)
+}
+
+// parseAllAttachments feeds attachments to workers, returns once every worker is done. Only attachments changed since
+// the previous pass are listed unless full scan is due or forced. Cancelling ctx stops picking up new attachments,
+// those in progress are finished unless work is cancelled too
+func (e *engine) parseAllAttachments(ctx context.Context, trigger string, forceFull bool) {
+	since := ""
+	if !forceFull {
+		since = e.scanSince()
+	}
+	full := since == ""
+	if full {
+		log.Info("[engine.go][parseAllAttachments] Started parsing all attachments")
+	} else {
+		log.Info("[engine.go][parseAllAttachments] Started parsing attachments changed since " + since)
+	}
+
+	// Record the pass in history
+	run := model.CreateRun(e.db, trigger, full, time.Now())
+	stats := &runStats{}
+	defer finishRun(e.db, run, stats)
+
+	// Bulk load Kitsu metadata, lookups fall back to single requests when it fails
+	before := e.kc.CacheStats()
+	if err := e.kc.Prewarm(ctx); err != nil {
+		log.Warn("[engine.go][parseAllAttachments] Failed to prewarm Kitsu cache: " + err.Error())
+	}
+	defer e.finishCache(before)
+
+	// Start workers
+	jobs := make(chan kitsu.Attachment)
+	var wg sync.WaitGroup
+	wg.Add(e.workers)
+	for i := 0; i < e.workers; i++ {
+		go func() {
+			defer wg.Done()
+			for elem := range jobs {
+				e.parseSingleAttachment(ctx, elem, stats)
+			}
+		}()
+	}
+
+	// enqueue hands the attachment to a worker, false once cancelled
+	enqueue := func(elem kitsu.Attachment) bool {
+		stats.scan(1)
+		select {
+		case jobs <- elem:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	var ids []string
+	var mark string
+	var listedAt time.Time
+	var err error
+	if !full {
+		mark, err = e.scanChanged(ctx, since, enqueue)
+		if err == errFilterIgnored {
+			log.Warn("[engine.go][parseAllAttachments] Kitsu ignores updated_at filter, only full scans are made from now on")
+			atomic.StoreInt32(&e.fullOnly, 1)
+		}
+		if err != nil && ctx.Err() == nil {
+			log.Warn("[engine.go][parseAllAttachments] Failed to list changes, falling back to full scan: " + err.Error())
+			full = true
+		}
+	}
+	if full {
+		listedAt = time.Now()
+		ids, mark, err = e.scanAll(ctx, enqueue)
+	}
+	close(jobs)
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		log.Warn("[engine.go][parseAllAttachments] Parsing cancelled: " + ctx.Err().Error())
+		stats.error("cancelled")
+		return
+	}
+
+	if err != nil {
+		log.Error("[engine.go][parseAllAttachments] Failed to list attachments: " + err.Error())
+		stats.error("list attachments: " + err.Error())
+		return
+	}
+	stats.complete(full, mark)
+
+	// Deletions are only detected on a complete list
+	if full && len(ids) > 0 {
+		// Propagate attachments deleted in Kitsu
+		handleDeletedAttachments(e.conf, e.db, e.destinations, ids, listedAt)
+	}
+
+	log.Info("[engine.go][parseAllAttachments] Finished parsing attachments")
+}
+
+// finishCache reports cache use during the pass and persists it
+func (e *engine) finishCache(before kitsu.CacheStats) {
+	after := e.kc.CacheStats()
+	if after.Entries == 0 {
+		return
+	}
+	log.Info("[engine.go][finishCache] Kitsu cache hits: " + strconv.FormatInt(after.Hits-before.Hits, 10) +
+		", misses: " + strconv.FormatInt(after.Misses-before.Misses, 10) +
+		", changed: " + strconv.FormatInt(after.Changed-before.Changed, 10))
+
+	saveKitsuCache(e.conf, e.db, e.kc)
+}
+
+// parseSingleAttachment backs up the attachment. ctx only stops it from starting, once started it runs on engine work context
+func (e *engine) parseSingleAttachment(ctx context.Context, attachment kitsu.Attachment, stats *runStats) {
+	// Shutting down
+	if ctx.Err() != nil {
+		return
+	}
+
+	log.Info("[engine.go][parseSingleAttachment] Started backing up '" + attachment.Name + "'")
+
+	// Ignore attachents with missing IDs
+	if attachment.ID == "" {
+		return
+	}
+
+	// Already in progress on another worker
+	if !e.claim(attachment.ID) {
+		return
+	}
+	defer e.unclaim(attachment.ID)
+
+	// Parse DB and ignore DONE unchanged attachments
+	result := model.FindAttachment(e.db, attachment.ID)
+
+	// Ignore attachments with extenstions from ignore list
+	for _, elem := range e.conf.Backup.IgnoreExtension {
+		if attachment.Extension == elem {
+			log.Info("[engine.go][parseSingleAttachment] Skipping ignored extension: " + elem + "\n")
+			skipAttachment(e.db, result, attachment, "ignored extension "+elem)
+			return
+		}
+	}
+
+	// Failed attachments wait for their turn unless changed in Kitsu
+	if result.AttachmentStatus == model.StatusFailed && result.AttachmentUpdatedAt == attachment.UpdatedAt &&
+		result.NextAttemptAt != nil && time.Now().Before(*result.NextAttemptAt) {
+		return
+	}
+
+	pending := pendingDestinations(e.db, e.destinations, result, attachment)
+	if len(pending) == 0 {
+		// Attachments backed up before locations were recorded get them filled in
+		if result.AttachmentStatus == model.StatusDone && result.AttachmentKey == "" {
+			e.backfillLocation(ctx, attachment)
+		}
+		// Attachments sent back to pending e.g. when they return to Kitsu are done once every destination has them
+		if result.AttachmentStatus == model.StatusPending {
+			model.SetAttachmentStatus(e.db, attachment.ID, model.StatusDone)
+		}
+		return
+	}
+
+	// Prepare local path
+	localPath := e.conf.Backup.LocalStorage + attachment.ID
+
+	// Prepare attachment name
+	if attachment.Name == "" {
+		skipAttachment(e.db, result, attachment, "attachment has no name")
+		return
+	}
+	attachmentName := utils.SanitizeString(attachment.Name)
+
+	// Look up Kitsu hierarchy for the key
+	if e.metadata.acquire(ctx) != nil {
+		return
+	}
+	s3Path, taskID, projectKey, err := buildAttachmentKey(e.work, e.conf, e.kc, e.keys, attachment)
+	e.metadata.release()
+	if err == errNoEntityName {
+		skipAttachment(e.db, result, attachment, err.Error())
+		return
+	}
+
+	model.StartAttachment(e.db, attachment.ID, attachment.UpdatedAt)
+	if err != nil {
+		log.Error("[engine.go][parseSingleAttachment] Failed to get path for '" + attachmentName + "': " + err.Error())
+		e.fail(stats, attachment.ID, err.Error())
+		return
+	}
+
+	log.Info("[engine.go][parseSingleAttachment] Formed path is: " + s3Path)
+
+	// Download file from Kitsu once, or stream it for every destination
+	var open func() (io.ReadCloser, error)
+	if e.conf.Backup.Stream {
+		open = func() (io.ReadCloser, error) {
+			return e.kc.OpenAttachment(e.work, attachment.ID, attachmentName)
+		}
+	} else {
+		if err := e.downloads.acquire(e.work); err != nil {
+			e.fail(stats, attachment.ID, "download: "+err.Error())
+			return
+		}
+		model.SetAttachmentStatus(e.db, attachment.ID, model.StatusDownloading)
+		_, err := e.kc.DownloadAttachment(e.work, localPath, attachment.ID, attachmentName)
+		e.downloads.release()
+
+		// Cleaning
+		defer os.RemoveAll(localPath)
+
+		if err != nil {
+			log.Error("[engine.go][parseSingleAttachment] Failed to download '" + attachmentName + "': " + err.Error())
+			e.fail(stats, attachment.ID, "download: "+err.Error())
+			return
+		}
+		open = func() (io.ReadCloser, error) {
+			return os.Open(localPath + "/" + attachmentName)
+		}
+	}
+
+	// Upload file to every destination it's missing from
+	model.SetAttachmentStatus(e.db, attachment.ID, model.StatusUploading)
+	var failed []string
+	for _, dest := range pending {
+		hash, size, err := e.upload(dest, open, s3Path)
+		if err != nil {
+			log.Error("[engine.go][parseSingleAttachment] Failed to back up '" + attachmentName + "' to '" + dest.Name + "': " + err.Error())
+			if e.work.Err() == nil {
+				model.SaveUpload(e.db, attachment.ID, dest.Name, attachment.UpdatedAt, s3Path, "", 0, "failed")
+			}
+			failed = append(failed, dest.Name+": "+err.Error())
+			continue
+		}
+		model.SaveUpload(e.db, attachment.ID, dest.Name, attachment.UpdatedAt, s3Path, hash, size, "done")
+		stats.transfer(size)
+		model.UpdateAttachmentChecksum(e.db, attachment.ID, hash, size)
+		log.Info("[engine.go][parseSingleAttachment] Uploaded '" + s3Path + "' to '" + dest.Name + "', sha256 " + hash)
+	}
+
+	// Attachment is done once every destination has it, failed ones are retried next run
+	model.UpdateAttachmentLocation(e.db, attachment.ID, attachment.Name, s3Path, attachment.CommentID, taskID, projectKey)
+	if len(failed) > 0 {
+		e.fail(stats, attachment.ID, "upload: "+strings.Join(failed, "; "))
+		return
+	}
+	model.FinishAttachment(e.db, attachment.ID)
+	stats.upload()
+
+	log.Info("[engine.go][parseSingleAttachment] Finished with '" + s3Path + "'")
+}
+
+// backfillLocation records where an attachment backed up before locations were tracked is stored. Those backups
+// were made with the default layout whatever path_template says now, the key is only recorded once the object is found
+func (e *engine) backfillLocation(ctx context.Context, attachment kitsu.Attachment) {
+	if e.metadata.acquire(ctx) != nil {
+		return
+	}
+	key, taskID, projectKey, err := buildAttachmentKey(e.work, e.conf, e.kc, e.legacyKeys, attachment)
+	e.metadata.release()
+	if err != nil {
+		log.Warn("[engine.go][backfillLocation] Failed to get path for '" + attachment.Name + "': " + err.Error())
+		return
+	}
+
+	found := false
+	for _, upload := range model.FindUploads(e.db, attachment.ID) {
+		if upload.AttachmentKey != "" {
+			continue
+		}
+		dest, ok := findDestination(e.destinations, upload.Destination)
+		if !ok {
+			continue
+		}
+		if _, err := dest.Stat(key); err != nil {
+			log.Warn("[engine.go][backfillLocation] Backup of '" + attachment.Name + "' not found at '" + key + "' in '" + dest.Name + "': " + err.Error())
+			continue
+		}
+		model.UpdateUploadKey(e.db, attachment.ID, upload.Destination, key)
+		found = true
+	}
+	if !found {
+		return
+	}
+
+	model.UpdateAttachmentLocation(e.db, attachment.ID, attachment.Name, key, attachment.CommentID, taskID, projectKey)
+	log.Info("[engine.go][backfillLocation] Recorded location of '" + attachment.Name + "': " + key)
+}
+
+// upload takes an upload slot, streaming from Kitsu takes a download slot as well
+func (e *engine) upload(dest storage.Destination, open func() (io.ReadCloser, error), s3Path string) (string, int64, error) {
+	if e.conf.Backup.Stream {
+		if err := e.downloads.acquire(e.work); err != nil {
+			return "", 0, err
+		}
+		defer e.downloads.release()
+	}
+	if err := e.uploads.acquire(e.work); err != nil {
+		return "", 0, err
+	}
+	defer e.uploads.release()
+
+	return uploadToDestination(e.work, dest, open, s3Path)
+}
+
+// fail records the failure, attachments aborted on shutdown go back to pending without counting an attempt
+func (e *engine) fail(stats *runStats, attachmentID, reason string) {
+	if e.work.Err() != nil {
+		log.Warn("[engine.go][fail] Attachment " + attachmentID + " aborted on shutdown")
+		model.SetAttachmentStatus(e.db, attachmentID, model.StatusPending)
+		return
+	}
+	failAttachment(e.conf, e.db, stats, attachmentID, reason)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"app/src/model"
+	"app/src/utils"
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// Run triggers
+const (
+	triggerStartup = "startup"
+	triggerCron    = "cron"
+	triggerManual  = "manual"
+	triggerLive    = "live"
+)
+
+// runStats collects counters of a single backup pass, safe for concurrent use. Counters go first to stay 64-bit aligned for atomics
+type runStats struct {
+	scanned  int64
+	uploaded int64
+	failed   int64
+	bytes    int64
+	errors   int64
+
+	mu        sync.Mutex
+	lastError string
+	full      bool
+	mark      string
+}
+
+func (s *runStats) scan(n int) {
+	atomic.AddInt64(&s.scanned, int64(n))
+}
+
+func (s *runStats) upload() {
+	atomic.AddInt64(&s.uploaded, 1)
+}
+
+func (s *runStats) transfer(n int64) {
+	atomic.AddInt64(&s.bytes, n)
+}
+
+func (s *runStats) fail(reason string) {
+	atomic.AddInt64(&s.failed, 1)
+	s.error(reason)
+}
+
+func (s *runStats) error(reason string) {
+	atomic.AddInt64(&s.errors, 1)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastError = reason
+}
+
+// complete records that Kitsu was listed completely up to the mark
+func (s *runStats) complete(full bool, mark string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.full = full
+	s.mark = mark
+}
+
+// finishRun saves counters of the pass, attachments neither uploaded nor failed count as skipped
+func finishRun(db *gorm.DB, run model.Run, stats *runStats) {
+	finishedAt := time.Now()
+	run.FinishedAt = &finishedAt
+	run.Scanned = int(atomic.LoadInt64(&stats.scanned))
+	run.Uploaded = int(atomic.LoadInt64(&stats.uploaded))
+	run.Failed = int(atomic.LoadInt64(&stats.failed))
+	run.Skipped = run.Scanned - run.Uploaded - run.Failed
+	run.Bytes = atomic.LoadInt64(&stats.bytes)
+	run.Errors = int(atomic.LoadInt64(&stats.errors))
+	stats.mu.Lock()
+	run.LastError = stats.lastError
+	if stats.mark != "" {
+		run.FullScan = stats.full
+		run.HighWaterMark = stats.mark
+	}
+	stats.mu.Unlock()
+	model.SaveRun(db, &run)
+
+	log.Info(fmt.Sprintf("[history.go][finishRun] Run finished in %s: scanned %d, uploaded %d, skipped %d, failed %d, %d bytes, %d errors",
+		finishedAt.Sub(run.StartedAt).Round(time.Second), run.Scanned, run.Uploaded, run.Skipped, run.Failed, run.Bytes, run.Errors))
+}
+
+func runHistory(conf utils.Config, args []string) {
+	flags := flag.NewFlagSet("history", flag.ExitOnError)
+	limitFlag := flags.Int("n", 10, "how many last runs to show")
+	flags.Parse(args)
+
+	// Connect to DB
+	db := openDB()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "STARTED\tDURATION\tTRIGGER\tSCAN\tSCANNED\tUPLOADED\tSKIPPED\tFAILED\tBYTES\tERRORS\tLAST ERROR")
+	for _, elem := range model.FindRuns(db, *limitFlag) {
+		duration := "running"
+		if elem.FinishedAt != nil {
+			duration = elem.FinishedAt.Sub(elem.StartedAt).Round(time.Second).String()
+		}
+		scan := "incremental"
+		switch {
+		case elem.FullScan:
+			scan = "full"
+		case elem.Trigger == triggerLive:
+			scan = "events"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\t%d\t%d\t%d\t%d\t%s\n",
+			elem.StartedAt.Format("2006-01-02 15:04:05"), duration, elem.Trigger, scan,
+			elem.Scanned, elem.Uploaded, elem.Skipped, elem.Failed, elem.Bytes, elem.Errors, utils.TruncateString(elem.LastError, 60))
+	}
+	w.Flush()
+}
@@ -0,0 +1,141 @@
+// Package layout forms storage keys of attachments from path_template in config
+package layout
+
+import (
+	"app/src/utils"
+	"errors"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// DefaultTemplate is the layout used before path_template was introduced:
+// Root/project/episode/shots|assets/Type|_Unsorted/sequence/entity/task type/name_<created_at>.ext
+const DefaultTemplate = `{{.Root}}/` +
+	`{{if .Lost}}LOST.FILES/{{.AttachmentID}}/` +
+	`{{else}}{{with .Project}}{{clean .}}/{{end}}{{with .Episode}}{{.}}/{{end}}` +
+	`{{if eq (clean .EntityType) "Shot"}}shots/{{else if .EntityType}}assets/{{clean .EntityType}}/{{else}}_Unsorted/{{end}}` +
+	`{{with .Sequence}}{{.}}/{{end}}{{clean .Entity}}/{{with .TaskType}}{{clean .}}/{{end}}{{end}}` +
+	`{{clean .Base}}_{{.Timestamp}}{{clean .Ext}}`
+
+// Vars are available in the template, Kitsu names are raw so use clean or slug helpers
+type Vars struct {
+	Root         string    // root_folder_name from [backup.s3]
+	Lost         bool      // attachment is not bound to any task
+	Project      string    // project name
+	Episode      string    // episode name, empty for projects without episodes
+	Sequence     string    // sequence name, empty for assets
+	Entity       string    // shot or asset name
+	EntityType   string    // entity type name e.g. Shot, Character, Prop
+	TaskType     string    // task type name e.g. Animation
+	Task         string    // task name
+	AttachmentID string    // Kitsu ID of the attachment
+	Name         string    // file name
+	Base         string    // file name without extension
+	Ext          string    // extension with leading dot, empty if there is none
+	CreatedAt    time.Time // when the attachment was uploaded to Kitsu
+	Timestamp    string    // created_at as Kitsu returns it with ":" replaced by "-"
+
+	author func() (string, error)
+}
+
+// NewVars fills name related vars, hierarchy vars are up to the caller. Author is looked up only when the template uses it
+func NewVars(root, attachmentID, name, createdAt string, author func() (string, error)) Vars {
+	ext := ""
+	base := name
+	if ind := strings.LastIndex(name, "."); ind > 0 {
+		base = name[:ind]
+		ext = name[ind:]
+	}
+
+	created, _ := time.Parse("2006-01-02T15:04:05", createdAt)
+
+	return Vars{
+		Root:         root,
+		AttachmentID: attachmentID,
+		Name:         name,
+		Base:         base,
+		Ext:          ext,
+		CreatedAt:    created,
+		Timestamp:    strings.ReplaceAll(createdAt, ":", "-"),
+		author:       author,
+	}
+}
+
+// Author returns full name of the comment author
+func (v Vars) Author() (string, error) {
+	if v.author == nil {
+		return "", nil
+	}
+	return v.author()
+}
+
+var nonSlug = regexp.MustCompile(`[^a-z0-9]+`)
+
+var funcs = template.FuncMap{
+	// clean drops characters not allowed in keys, names stay as they are otherwise
+	"clean": utils.SanitizeString,
+	// slug turns a name into lowercase words joined by dashes e.g. "Main Character" -> "main-character"
+	"slug": func(s string) string {
+		return strings.Trim(nonSlug.ReplaceAllString(strings.ToLower(s), "-"), "-")
+	},
+	// date formats time with Go layout e.g. {{date "2006/01" .CreatedAt}}
+	"date": func(layout string, t time.Time) string {
+		return t.Format(layout)
+	},
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+}
+
+// samples are attachments the template is tried on when parsed, typos in field names fail at startup instead of
+// on every attachment. Hierarchy is full in one and missing in others so both sides of conditions are executed
+var samples = []Vars{
+	{Root: "kitsu", Project: "Project", Episode: "E01", Sequence: "SQ01", Entity: "SH010", EntityType: "Shot", TaskType: "Animation", Task: "Main"},
+	{Root: "kitsu", Project: "Project", Entity: "Chair", EntityType: "Prop", TaskType: "Modeling", Task: "Main"},
+	{Root: "kitsu", Lost: true},
+}
+
+// Template forms keys, safe for concurrent use
+type Template struct {
+	tmpl *template.Template
+}
+
+// New parses path template, DefaultTemplate is used when it's empty
+func New(text string) (*Template, error) {
+	if strings.TrimSpace(text) == "" {
+		text = DefaultTemplate
+	}
+
+	tmpl, err := template.New("path_template").Funcs(funcs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Template{tmpl: tmpl}
+	for _, elem := range samples {
+		vars := NewVars(elem.Root, "0a1b2c3d", "preview.mov", "2022-03-01T10:20:30", func() (string, error) {
+			return "Jane Doe", nil
+		})
+		vars.Lost, vars.Project, vars.Episode, vars.Sequence = elem.Lost, elem.Project, elem.Episode, elem.Sequence
+		vars.Entity, vars.EntityType, vars.TaskType, vars.Task = elem.Entity, elem.EntityType, elem.TaskType, elem.Task
+		if _, err := t.Key(vars); err != nil {
+			return nil, err
+		}
+	}
+
+	return t, nil
+}
+
+// Key executes the template for the attachment
+func (t *Template) Key(vars Vars) (string, error) {
+	var key strings.Builder
+	if err := t.tmpl.Execute(&key, vars); err != nil {
+		return "", err
+	}
+	if key.Len() == 0 || strings.HasSuffix(key.String(), "/") {
+		return "", errors.New("path template gives no file name")
+	}
+
+	return key.String(), nil
+}
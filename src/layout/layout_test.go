@@ -0,0 +1,108 @@
+package layout
+
+import (
+	"app/src/utils"
+	"strings"
+	"testing"
+)
+
+// legacyKey is how keys were formed before path_template, backfilled locations rely on DefaultTemplate giving the same
+func legacyKey(vars Vars) string {
+	name := utils.SanitizeString(vars.Name)
+
+	var key string
+	if vars.Lost {
+		key = vars.Root + "/LOST.FILES/" + vars.AttachmentID + "/" + name
+	} else {
+		project, episode, sequence, entityType, taskType := "", "", "", "_Unsorted/", ""
+		if vars.Project != "" {
+			project = utils.SanitizeString(vars.Project) + "/"
+		}
+		if vars.Episode != "" {
+			episode = vars.Episode + "/"
+		}
+		if vars.Sequence != "" {
+			sequence = vars.Sequence + "/"
+		}
+		if vars.EntityType != "" {
+			if utils.SanitizeString(vars.EntityType) == "Shot" {
+				entityType = "shots/"
+			} else {
+				entityType = "assets/" + utils.SanitizeString(vars.EntityType) + "/"
+			}
+		}
+		if vars.TaskType != "" {
+			taskType = utils.SanitizeString(vars.TaskType) + "/"
+		}
+		key = vars.Root + "/" + project + episode + entityType + sequence + utils.SanitizeString(vars.Entity) + "/" + taskType + name
+	}
+
+	if ind := strings.LastIndex(key, "."); ind > 0 {
+		return key[:ind] + "_" + vars.Timestamp + key[ind:]
+	}
+	return key + "_" + vars.Timestamp
+}
+
+func TestDefaultTemplateMatchesLegacyKeys(t *testing.T) {
+	keys, err := New("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		file  string
+		setup func(*Vars)
+	}{
+		{"shot with episode", "preview.mov", func(v *Vars) {
+			v.Project, v.Episode, v.Sequence, v.Entity, v.EntityType, v.TaskType = "Big Film", "E01", "SQ01", "SH010", "Shot", "Animation"
+		}},
+		{"shot", "preview.v2.mp4", func(v *Vars) {
+			v.Project, v.Sequence, v.Entity, v.EntityType, v.TaskType = "Big Film", "SQ01", "SH010", "Shot", "Compositing"
+		}},
+		{"asset", "chair.png", func(v *Vars) {
+			v.Project, v.Entity, v.EntityType, v.TaskType = "Big Film", "Chair", "Prop", "Modeling"
+		}},
+		{"no entity type nor task type", "notes.txt", func(v *Vars) {
+			v.Project, v.Entity = "Big Film", "Misc"
+		}},
+		{"no extension", "README", func(v *Vars) {
+			v.Project, v.Entity, v.EntityType, v.TaskType = "Big Film", "Chair", "Prop", "Modeling"
+		}},
+		{"lost", "orphan.jpg", func(v *Vars) {
+			v.Lost = true
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vars := NewVars("kitsu", "0a1b2c3d", tt.file, "2022-03-01T10:20:30", nil)
+			tt.setup(&vars)
+
+			key, err := keys.Key(vars)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := legacyKey(vars); key != want {
+				t.Errorf("key %q, legacy key %q", key, want)
+			}
+		})
+	}
+}
+
+func TestNewRejectsUnknownFields(t *testing.T) {
+	for _, text := range []string{
+		`{{.Root}}/{{.Projcet}}/{{.Name}}`,
+		`{{.Root}}/{{if .Lost}}{{.AttachmentId}}{{else}}{{.Project}}{{end}}/{{.Name}}`,
+		`{{.Root}}/{{with .Episode}}{{.Nmae}}/{{end}}{{.Name}}`,
+		`{{.Root}}/{{.Project}}/`,
+	} {
+		if _, err := New(text); err == nil {
+			t.Errorf("New(%q) accepted the template", text)
+		}
+	}
+
+	if _, err := New(`{{.Root}}/{{slug .Project}}/{{date "2006/01" .CreatedAt}}/{{.Author}}/{{.Name}}`); err != nil {
+		t.Errorf("New rejected valid template: %s", err)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"app/src/api/events"
+	"app/src/api/kitsu"
+	"app/src/model"
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// liveQueueSize is how many events wait for workers, events over it are dropped and left for the next scan
+const liveQueueSize = 1000
+
+// eventData holds IDs Kitsu events carry
+type eventData struct {
+	AttachmentFileID string `json:"attachment_file_id"`
+	CommentID        string `json:"comment_id"`
+	TaskID           string `json:"task_id"`
+	ShotID           string `json:"shot_id"`
+	AssetID          string `json:"asset_id"`
+	SequenceID       string `json:"sequence_id"`
+	EpisodeID        string `json:"episode_id"`
+}
+
+// runLive backs up attachments as Kitsu reports them until ctx is done. Live mode has workers of its own,
+// metadata, download and upload limits are shared with scans
+func (e *engine) runLive(ctx context.Context) {
+	endpoint := e.conf.Kitsu.EventsURL
+	if endpoint == "" {
+		endpoint = e.kc.BaseURL + "socket.io/"
+	}
+	log.Info("[live.go][runLive] Listening to Kitsu events at " + endpoint)
+
+	// Record attachments backed up on events in history
+	run := model.CreateRun(e.db, triggerLive, false, time.Now())
+	stats := &runStats{}
+	defer finishRun(e.db, run, stats)
+
+	// Lookups run on workers so the stream is polled without delay
+	jobs := make(chan events.Event, liveQueueSize)
+	var wg sync.WaitGroup
+	wg.Add(e.workers)
+	for i := 0; i < e.workers; i++ {
+		go func() {
+			defer wg.Done()
+			for elem := range jobs {
+				e.parseEvent(ctx, elem, stats)
+			}
+		}()
+	}
+
+	client := events.NewClient(endpoint, e.conf.Retry, e.kc.FreshToken)
+	client.Listen(ctx, func(event events.Event) {
+		log.Debug("[live.go][runLive] Received " + event.Name + ": " + string(event.Data))
+		select {
+		case jobs <- event:
+		default:
+			log.Warn("[live.go][runLive] Too many events waiting, dropping " + event.Name)
+		}
+	})
+	close(jobs)
+	wg.Wait()
+
+	log.Info("[live.go][runLive] Stopped listening to Kitsu events")
+}
+
+// parseEvent backs up attachments the event is about. New comments may carry attachments, other events
+// are only looked into when they name an attachment
+func (e *engine) parseEvent(ctx context.Context, event events.Event, stats *runStats) {
+	if ctx.Err() != nil {
+		return
+	}
+
+	var data eventData
+	if err := json.Unmarshal(event.Data, &data); err != nil {
+		return
+	}
+
+	// Changed tasks and entities are looked up again next time
+	if strings.HasPrefix(event.Name, "task:") && data.TaskID != "" {
+		e.kc.Invalidate("tasks", data.TaskID, "")
+	}
+	for _, id := range []string{data.ShotID, data.AssetID, data.SequenceID, data.EpisodeID} {
+		if id != "" {
+			e.kc.Invalidate("entities", id, "")
+		}
+	}
+
+	var ids []string
+	switch {
+	case data.AttachmentFileID != "":
+		ids = append(ids, data.AttachmentFileID)
+	case data.CommentID != "" && (event.Name == "comment:new" || event.Name == "comment:update"):
+		comment, err := e.kc.GetCommentByID(ctx, data.CommentID)
+		if err != nil {
+			log.Warn("[live.go][parseEvent] Failed to get comment " + data.CommentID + ": " + err.Error())
+			return
+		}
+		ids = comment.AttachmentFiles
+	}
+
+	for _, id := range ids {
+		attachment, err := e.fetchAttachment(ctx, id)
+		if err != nil {
+			if !kitsu.IsNotFound(err) {
+				log.Warn("[live.go][parseEvent] Failed to get attachment " + id + ": " + err.Error())
+			}
+			continue
+		}
+		stats.scan(1)
+		e.parseSingleAttachment(ctx, attachment, stats)
+	}
+}
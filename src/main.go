@@ -1,17 +1,27 @@
 package main
 
 import (
+	"app/src/api/azure"
+	"app/src/api/fs"
+	"app/src/api/gcs"
 	"app/src/api/kitsu"
 	"app/src/api/s3"
+	"app/src/api/sftp"
+	"app/src/layout"
 	"app/src/model"
+	"app/src/storage"
 	"app/src/utils"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/robfig/cron/v3"
@@ -30,272 +40,448 @@ func main() {
 	conf := utils.ConfRead()
 	log.Info("[main.go][main] Config read successfully")
 
-	// Auth to Kitsu to get JWT token
-	JWTToken := utils.AuthForJWTToken(conf.Kitsu.Hostname+"api/auth/login", conf.Kitsu.Email, conf.Kitsu.Password)
-	os.Setenv("KitsuJWTToken", JWTToken)
-	log.Info("[main.go][main] JWT token acquired")
+	// Debug messages e.g. Kitsu requests are shown only when asked for in config
+	if conf.Debug {
+		log.SetLevel(log.DebugLevel)
+	}
 
-	// Connect to DB
-	db, err := gorm.Open(sqlite.Open("sqlite.db"), &gorm.Config{})
-	if err != nil {
-		log.Error("[main.go][main] Failed to connect database")
+	// Pick command, running backup daemon is the default
+	command := "backup"
+	if len(os.Args) > 1 {
+		command = os.Args[1]
+	}
+
+	var args []string
+	if len(os.Args) > 2 {
+		args = os.Args[2:]
+	}
+
+	switch command {
+	case "backup":
+		runBackup(conf, args)
+	case "restore":
+		runRestore(conf, args)
+	case "restore-local":
+		runRestoreLocal(conf, args)
+	case "prune":
+		runPrune(conf, args)
+	case "history":
+		runHistory(conf, args)
+	case "migrate-layout":
+		runMigrateLayout(conf, args)
+	default:
+		log.Error("[main.go][main] Unknown command '" + command + "'")
+		fmt.Println("Usage: app [backup|restore|restore-local|prune|history|migrate-layout] [options]")
 		os.Exit(1)
 	}
-	db.AutoMigrate(&model.Attachment{})
+}
+
+func runBackup(conf utils.Config, args []string) {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	onceFlag := flags.Bool("once", false, "run a single backup pass and exit instead of polling on schedule")
+	fullFlag := flags.Bool("full", false, "list every attachment on the first pass instead of changes only")
+	flags.Parse(args)
+
+	// Local storage is needed unless downloads are piped into storage
+	if !conf.Backup.Stream && conf.Backup.LocalStorage == "" {
+		log.Error("[main.go][runBackup] Set local_storage or enable stream in config")
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+
+	// Auth to Kitsu to get JWT token
+	kc := openKitsu(ctx, conf)
+
+	// Connect to DB
+	db := openDB()
+
+	// Kitsu metadata looked up by the previous process
+	loadKitsuCache(conf, db, kc)
+
+	// Attachments left in progress by a killed process start over
+	model.ResetInterruptedAttachments(db)
+
+	// Connect to storages
+	destinations := openDestinations(conf)
+
+	// Parse key layout
+	keys := openLayout(conf)
 
 	// Setup CRON on schedule
 	c := cron.New(cron.WithChain(
 		cron.DelayIfStillRunning(cron.DefaultLogger),
 	))
 
+	// Stop picking up attachments on SIGTERM/SIGINT, in-flight ones are aborted after shutdown_timeout
+	stop, work := handleShutdown(conf)
+
+	// Prepare workers
+	e := newEngine(work, conf, db, kc, keys, destinations)
+
+	// Single pass requested by hand
+	if *onceFlag {
+		log.Info("[main.go][runBackup] Parse all attachments once")
+		if !conf.Backup.Stream {
+			utils.EmptyDir(conf.Backup.LocalStorage)
+		}
+		e.parseAllAttachments(stop, triggerManual, *fullFlag)
+		finishShutdown(db)
+		return
+	}
+
+	// Leftovers of the previous run are removed before any worker starts. Live workers download all the time and
+	// remove their own files, so the folder is not emptied again while they run
+	if !conf.Backup.Stream {
+		utils.EmptyDir(conf.Backup.LocalStorage)
+	}
+
+	// Back up attachments as Kitsu reports them, scans on schedule catch anything missed
+	live := make(chan struct{})
+	if conf.Backup.Live {
+		go func() {
+			defer close(live)
+			e.runLive(stop)
+		}()
+	} else {
+		close(live)
+	}
+
 	// Update tray icon
-	log.Info("[main.go][main] Parse all attachments on first run")
-	utils.EmptyDir(conf.Backup.LocalStorage)
-	parseAllAttachments(conf, db)
+	log.Info("[main.go][runBackup] Parse all attachments on first run")
+	e.parseAllAttachments(stop, triggerStartup, *fullFlag)
 	c.AddFunc("@every "+strconv.Itoa(conf.Backup.PollDuration)+"m", func() {
-		log.Info("[main.go][main] Parse all attachments on CRON job")
-		utils.EmptyDir(conf.Backup.LocalStorage)
-		parseAllAttachments(conf, db)
+		if stop.Err() != nil {
+			return
+		}
+		log.Info("[main.go][runBackup] Parse all attachments on CRON job")
+		if !conf.Backup.Stream && !conf.Backup.Live {
+			utils.EmptyDir(conf.Backup.LocalStorage)
+		}
+		e.parseAllAttachments(stop, triggerCron, false)
 
 	})
-	log.Info("[main.go][main] Run CRON")
-	c.Run()
+	log.Info("[main.go][runBackup] Run CRON")
+	c.Start()
+
+	// Wait for the signal and the job in progress
+	<-stop.Done()
+	<-c.Stop().Done()
+	<-live
+	finishShutdown(db)
 }
 
-func parseAllAttachments(conf utils.Config, db *gorm.DB) {
-	log.Info("[main.go][parseAllAttachments] Started parsing all attachments")
+func openKitsu(ctx context.Context, conf utils.Config) *kitsu.Client {
+	kc := kitsu.NewClient(conf)
+	if err := kc.Login(ctx, conf.Kitsu.Email, conf.Kitsu.Password); err != nil {
+		log.Error("[main.go][openKitsu] Failed to log in to Kitsu: " + err.Error())
+		os.Exit(1)
+	}
+	log.Info("[main.go][openKitsu] JWT token acquired")
 
-	// Get all Attachments
-	array := kitsu.GetAttachments()
+	return kc
+}
 
-	if len(array.Each) <= 0 {
+// loadKitsuCache fills metadata cache from DB when persist_cache is on
+func loadKitsuCache(conf utils.Config, db *gorm.DB, kc *kitsu.Client) {
+	if conf.Kitsu.CacheTTL <= 0 || !conf.Kitsu.PersistCache {
 		return
 	}
 
-	// Concurent threads from conf
-	threads := conf.Backup.Threads
+	var entries []kitsu.CacheEntry
+	for _, elem := range model.FindKitsuObjects(db, time.Now()) {
+		entries = append(entries, kitsu.CacheEntry{Path: elem.ObjectPath, UpdatedAt: elem.ObjectUpdatedAt, Data: elem.Data, ExpiresAt: elem.ExpiresAt})
+	}
+	kc.ImportCache(entries)
+	log.Info("[main.go][loadKitsuCache] Loaded " + strconv.Itoa(len(entries)) + " cached Kitsu objects")
+}
+
+// saveKitsuCache persists metadata cache when persist_cache is on
+func saveKitsuCache(conf utils.Config, db *gorm.DB, kc *kitsu.Client) {
+	if conf.Kitsu.CacheTTL <= 0 || !conf.Kitsu.PersistCache {
+		return
+	}
 
-	var count int
+	var objects []model.KitsuObject
+	for _, elem := range kc.ExportCache() {
+		objects = append(objects, model.KitsuObject{ObjectPath: elem.Path, ObjectUpdatedAt: elem.UpdatedAt, Data: elem.Data, ExpiresAt: elem.ExpiresAt})
+	}
+	if err := model.ReplaceKitsuObjects(db, objects); err != nil {
+		log.Error("[main.go][saveKitsuCache] Failed to save Kitsu cache: " + err.Error())
+	}
+}
 
-	if threads < 0 {
-		// Async
-		var wg sync.WaitGroup
-		wg.Add(len(array.Each))
+func openDestinations(conf utils.Config) []storage.Destination {
+	var destinations []storage.Destination
+	names := map[string]bool{}
 
-		for _, elem := range array.Each {
-			go func(elem kitsu.Attachment) {
-				defer wg.Done()
-				resp := parseSingleAttachment(conf, db, elem)
-				if resp {
-					count++
-				}
-			}(elem)
+	for _, elem := range conf.BackupDestinations() {
+		if elem.Name == "" || names[elem.Name] {
+			log.Error("[main.go][openDestinations] Every destination needs a unique name, got '" + elem.Name + "'")
+			os.Exit(1)
 		}
-		wg.Wait()
-
-	} else if threads == 0 {
-		// Sync
-		for _, elem := range array.Each {
-			resp := parseSingleAttachment(conf, db, elem)
-			if resp {
-				count++
-			}
+		names[elem.Name] = true
+
+		var store storage.Storage
+		var err error
+
+		switch elem.Type {
+		case "", "s3":
+			store, err = s3.NewClient(elem.S3, s3.WithRetry(conf.Retry))
+		case "fs":
+			store, err = fs.NewClient(elem.Path)
+		case "sftp":
+			store, err = sftp.NewClient(elem.SFTP)
+		case "azure":
+			store, err = azure.NewClient(elem.Azure)
+		case "gcs":
+			store, err = gcs.NewClient(elem.GCS)
+		default:
+			err = fmt.Errorf("unknown storage type '%s'", elem.Type)
 		}
-
-	} else if threads > 0 {
-		// Semafore async
-		var sem = make(chan int, threads)
-
-		for _, elem := range array.Each {
-			sem <- 1
-			go func() {
-
-				resp := parseSingleAttachment(conf, db, elem)
-				if resp {
-					count++
-				}
-				<-sem
-			}()
+		if err != nil {
+			log.Error("[main.go][openDestinations] Failed to open destination '" + elem.Name + "': " + err.Error())
+			os.Exit(1)
 		}
 
+		destinations = append(destinations, storage.Destination{Name: elem.Name, Storage: store})
 	}
 
-	if count > 0 {
+	return destinations
+}
 
+// pickDestination returns destination by name, the first one when name is empty
+func pickDestination(destinations []storage.Destination, name string) storage.Destination {
+	if name == "" {
+		return destinations[0]
+	}
+	for _, elem := range destinations {
+		if elem.Name == name {
+			return elem
+		}
 	}
-	log.Info("[main.go][parseAllAttachments] Finished parsing all attachments")
 
+	log.Error("[main.go][pickDestination] Unknown destination '" + name + "'")
+	os.Exit(1)
+	return storage.Destination{}
 }
 
-func parseSingleAttachment(conf utils.Config, db *gorm.DB, attachment kitsu.Attachment) bool {
-	log.Info("[main.go][parseSingleAttachment] Started backing up '" + attachment.Name + "'")
-
-	// Ignore attachents with missing IDs
-	if attachment.ID == "" {
-		return false
+func openDB() *gorm.DB {
+	db, err := gorm.Open(sqlite.Open("sqlite.db"), &gorm.Config{})
+	if err != nil {
+		log.Error("[main.go][openDB] Failed to connect database")
+		os.Exit(1)
 	}
+	db.AutoMigrate(&model.Attachment{}, &model.Upload{}, &model.Run{}, &model.KitsuObject{})
 
-	// Ignore attachments with extenstions from ignore list
-	for _, elem := range conf.Backup.IgnoreExtension {
-		if attachment.Extension == elem {
-			log.Info("[main.go][parseSingleAttachment] Skipping ignored extension: " + elem + "\n")
-			return false
-		}
+	// SQLite takes a single writer, workers wait for their turn instead of failing with "database is locked"
+	if sqlDB, err := db.DB(); err == nil {
+		sqlDB.SetMaxOpenConns(1)
 	}
 
-	// Parse DB and ignore DONE unchanged attachments
-	result := model.FindAttachment(db, attachment.ID)
-	if len(result.AttachmentID) > 0 {
-		if result.AttachmentStatus == "done" && result.AttachmentUpdatedAt == attachment.UpdatedAt {
-			return false
-		}
+	return db
+}
+
+// skipAttachment records the attachment as skipped unless it's already backed up or recorded
+func skipAttachment(db *gorm.DB, result model.Attachment, attachment kitsu.Attachment, reason string) {
+	if result.AttachmentStatus == model.StatusDone {
+		return
+	}
+	if result.AttachmentStatus == model.StatusSkipped && result.AttachmentUpdatedAt == attachment.UpdatedAt {
+		return
 	}
+	model.SkipAttachment(db, attachment.ID, attachment.UpdatedAt, reason)
+}
 
-	// Prepare local path
-	localPath := conf.Backup.LocalStorage + attachment.ID
+// failAttachment records the failure and postpones the next attempt, waiting twice longer after each one
+func failAttachment(conf utils.Config, db *gorm.DB, stats *runStats, attachmentID, reason string) {
+	stats.fail(attachmentID + ": " + reason)
 
-	// Prepare attachment name
-	attachmentName := ""
-	if attachment.Name != "" {
-		attachmentName = utils.SanitizeString(attachment.Name)
-	} else {
-		return false
+	attempts := model.FindAttachment(db, attachmentID).Attempts
+
+	delay := time.Duration(conf.Backup.PollDuration) * time.Minute
+	maxDelay := time.Duration(conf.Backup.FailedMaxDelay) * time.Hour
+	if maxDelay <= 0 {
+		maxDelay = 24 * time.Hour
+	}
+	for i := 0; i < attempts && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
 	}
 
-	s3Path := ""
+	model.FailAttachment(db, attachmentID, reason, time.Now().Add(delay))
+	log.Warn("[main.go][failAttachment] Attachment " + attachmentID + " failed " + strconv.Itoa(attempts+1) + " time(s), next attempt in " + delay.String())
+}
 
-	if attachment.Comment.ObjectID != "" {
+// errNoEntityName skips attachments of unnamed entities, there is no path to put them to
+var errNoEntityName = errors.New("entity has no name")
 
-		task := kitsu.GetTask(attachment.Comment.ObjectID)
+// buildAttachmentKey forms storage key of the attachment from path template, returns task ID and project name as well
+func buildAttachmentKey(ctx context.Context, conf utils.Config, kc *kitsu.Client, keys *layout.Template, attachment kitsu.Attachment) (string, string, string, error) {
+	vars, taskID, err := attachmentVars(ctx, conf, kc, attachment)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	key, err := keys.Key(vars)
+	if err != nil {
+		return "", "", "", err
+	}
 
-		/*
-			## Kitsu help sheet
-			Entity - an actual task e.g. shot01, or prop_chair
-			Entity Type - category where Entity belongs e.g.: sho01 is a Shot
-			Task Type - Assets/Shots's categories (column name in Kitsu UI)
-			Task - actual task's sub-task that fits into the column
-		*/
+	return key, taskID, utils.SanitizeString(vars.Project), nil
+}
 
-		// Get entity name (Top Task)
-		log.Info("[main.go][parseSingleAttachment] ** Entity: **")
-		entity := kitsu.GetEntity(task.EntityID)
-		log.Info(entity)
-		entityName := ""
-		if entity.Name != "" {
-			entityName = utils.SanitizeString(entity.Name) + "/"
-		} else {
-			return false
+// attachmentVars collects Kitsu hierarchy of the attachment for path template, returns task ID as well
+func attachmentVars(ctx context.Context, conf utils.Config, kc *kitsu.Client, attachment kitsu.Attachment) (layout.Vars, string, error) {
+	vars := layout.NewVars(conf.Backup.S3.RootFolderName, attachment.ID, attachment.Name, attachment.CreatedAt, func() (string, error) {
+		comment, err := kc.GetCommentByID(ctx, attachment.CommentID)
+		if err != nil {
+			return "", err
 		}
+		person, err := kc.GetPerson(ctx, comment.PersonID)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(person.FirstName + " " + person.LastName), nil
+	})
 
-		// Get Sequence Name
-		sequenceName := ""
-		episodeName := ""
-		if entity.ParentID != "" {
-			sequence := kitsu.GetEntity(entity.ParentID)
-			sequenceName = sequence.Name + "/"
-
-			// Get Episode Name
-			if sequence.ParentID != "" {
-				episode := kitsu.GetEntity(sequence.ParentID)
-				episodeName = episode.Name + "/"
-			}
+	if attachment.Comment.ObjectID == "" {
+		vars.Lost = true
+		return vars, "", nil
+	}
 
-		}
+	task, err := kc.GetTask(ctx, attachment.Comment.ObjectID)
+	if err != nil {
+		return vars, "", err
+	}
+	vars.Task = task.Name
+
+	/*
+		## Kitsu help sheet
+		Entity - an actual task e.g. shot01, or prop_chair
+		Entity Type - category where Entity belongs e.g.: sho01 is a Shot
+		Task Type - Assets/Shots's categories (column name in Kitsu UI)
+		Task - actual task's sub-task that fits into the column
+	*/
+
+	// Get entity name (Top Task)
+	entity, err := kc.GetEntity(ctx, task.EntityID)
+	if err != nil {
+		return vars, "", err
+	}
+	if entity.Name == "" {
+		return vars, "", errNoEntityName
+	}
+	vars.Entity = entity.Name
 
-		// Get entity type
-		log.Info("[main.go][parseSingleAttachment] ** Entity Type: **")
-		entityType := kitsu.GetEntityType(entity.EntityTypeID)
-		log.Info(entityType)
-		entityTypeName := ""
-		if entityType.Name == "" {
-			entityTypeName = "_Unsorted" + "/"
-		} else {
-			// Make more verbose divide between Shots and Assets type
-			if utils.SanitizeString(entityType.Name) == "Shot" {
-				entityTypeName = "shots/"
-			} else {
-				entityTypeName = "assets/" + utils.SanitizeString(entityType.Name) + "/"
-			}
+	// Get Sequence Name
+	if entity.ParentID != "" {
+		sequence, err := kc.GetEntity(ctx, entity.ParentID)
+		if err != nil {
+			return vars, "", err
 		}
+		vars.Sequence = sequence.Name
 
-		// Get task type (Sub Task)
-		log.Info("[main.go][parseSingleAttachment] ** Task Type: **")
-		taskType := kitsu.GetTaskType(task.TaskTypeID)
-		log.Info(taskType)
-		taskTypeName := ""
-		if taskType.Name != "" {
-			taskTypeName = utils.SanitizeString(taskType.Name) + "/"
+		// Get Episode Name
+		if sequence.ParentID != "" {
+			episode, err := kc.GetEntity(ctx, sequence.ParentID)
+			if err != nil {
+				return vars, "", err
+			}
+			vars.Episode = episode.Name
 		}
+	}
 
-		// Get Project
-		log.Info("[main.go][parseSingleAttachment] ** Project: **")
-		project := kitsu.GetProject(task.ProjectID)
-		log.Info(project)
-		projectName := ""
-		if project.Name != "" {
-			projectName = utils.SanitizeString(project.Name) + "/"
-		}
-		//projectStatus := kitsu.GetProjectStatus(project.ProjectStatusID)
+	// Get entity type
+	entityType, err := kc.GetEntityType(ctx, entity.EntityTypeID)
+	if err != nil {
+		return vars, "", err
+	}
+	vars.EntityType = entityType.Name
 
-		s3Path = conf.Backup.S3.RootFolderName + "/" + projectName + episodeName + entityTypeName + sequenceName + entityName + taskTypeName + attachmentName
-	} else {
-		s3Path = conf.Backup.S3.RootFolderName + "/" + "LOST.FILES" + "/" + attachment.ID + "/" + attachmentName
+	// Get task type (Sub Task)
+	taskType, err := kc.GetTaskType(ctx, task.TaskTypeID)
+	if err != nil {
+		return vars, "", err
 	}
+	vars.TaskType = taskType.Name
 
-	// Alter file path to add timestamp postfix
-	datetime := strings.ReplaceAll(attachment.CreatedAt, ":", "-")
-	lastInd := strings.LastIndex(s3Path, ".")
-	if lastInd > 0 {
-		//fmt.Println(filename[:lastInd])   // o/p: a_ab_daqe_sd
-		//fmt.Println(filename[lastInd+1:]) // o/p: ew
-		s3Path = s3Path[:lastInd] + "_" + datetime + "." + s3Path[lastInd+1:]
-	} else {
-		s3Path = s3Path + "_" + datetime
+	// Get Project
+	project, err := kc.GetProject(ctx, task.ProjectID)
+	if err != nil {
+		return vars, "", err
 	}
+	vars.Project = project.Name
 
-	log.Info("[main.go][parseSingleAttachment] Formed path is: " + s3Path)
+	return vars, task.ID, nil
+}
 
-	if len(result.AttachmentID) > 0 {
-		// check if status is different or last comment date don't match
-		if result.AttachmentStatus != "done" || result.AttachmentUpdatedAt != attachment.UpdatedAt {
-			// update
-			model.UpdateAttachment(db, attachment.ID, attachment.UpdatedAt, "new")
-			kitsu.DownloadAttachment(localPath, attachment.ID, attachmentName, conf)
+// openLayout parses path template from config
+func openLayout(conf utils.Config) *layout.Template {
+	keys, err := layout.New(conf.Backup.PathTemplate)
+	if err != nil {
+		log.Error("[main.go][openLayout] Failed to parse path_template: " + err.Error())
+		os.Exit(1)
+	}
 
-			// Read file from local dir
-			content, err := ioutil.ReadFile(localPath + "/" + attachmentName)
-			if err != nil {
-				panic(err)
-			}
+	return keys
+}
 
-			// Upload file to S3 storage
-			s3.UploadFile(s3Path, string(content), conf)
-			model.UpdateAttachment(db, attachment.ID, attachment.UpdatedAt, "done")
-		} else {
-			log.Info("[main.go][parseSingleAttachment] Skipping existing attachment: " + attachmentName)
-			return false
+// pendingDestinations returns destinations that don't have the current version of the attachment yet
+func pendingDestinations(db *gorm.DB, destinations []storage.Destination, result model.Attachment, attachment kitsu.Attachment) []storage.Destination {
+	var pending []storage.Destination
+	for _, dest := range destinations {
+		// Pruned versions were uploaded before and removed on purpose
+		upload := model.FindUpload(db, attachment.ID, dest.Name)
+		if (upload.UploadStatus == "done" || upload.UploadStatus == "pruned") && upload.AttachmentUpdatedAt == attachment.UpdatedAt {
+			continue
 		}
 
-	} else {
-		// create
-		// Download file from Kitsu
-		model.CreateAttachment(db, attachment.ID, attachment.UpdatedAt, "new")
-		kitsu.DownloadAttachment(localPath, attachment.ID, attachmentName, conf)
-
-		// Read file from local dir
-		content, err := ioutil.ReadFile(localPath + "/" + attachmentName)
-		if err != nil {
-			panic(err)
+		// Attachments backed up before destinations were tracked belong to the default one
+		if upload.ID == 0 && dest.Name == "default" && result.AttachmentStatus == model.StatusDone && result.AttachmentUpdatedAt == attachment.UpdatedAt {
+			model.SaveUpload(db, attachment.ID, dest.Name, result.AttachmentUpdatedAt, result.AttachmentKey, result.AttachmentHash, result.AttachmentSize, "done")
+			continue
 		}
-		// Upload file to S3 storage
-		s3.UploadFile(s3Path, string(content), conf)
-		model.UpdateAttachment(db, attachment.ID, attachment.UpdatedAt, "done")
+
+		pending = append(pending, dest)
+	}
+
+	return pending
+}
+
+// uploadToDestination opens the attachment content and uploads it to a single destination
+func uploadToDestination(ctx context.Context, dest storage.Destination, open func() (io.ReadCloser, error), s3Path string) (string, int64, error) {
+	content, err := open()
+	if err != nil {
+		return "", 0, err
+	}
+	defer content.Close()
+
+	return uploadWithHash(ctx, dest, content, s3Path)
+}
+
+// uploadWithHash uploads content to storage computing its SHA-256 on the fly and verifies the stored size
+func uploadWithHash(ctx context.Context, store storage.Storage, content io.Reader, s3Path string) (string, int64, error) {
+	hasher := sha256.New()
+	counter := &utils.CountingWriter{}
+
+	err := storage.Put(ctx, store, s3Path, io.TeeReader(content, io.MultiWriter(hasher, counter)))
+	if err != nil {
+		return "", 0, err
+	}
+
+	// Verify the stored object matches what was read from Kitsu
+	object, err := store.Stat(s3Path)
+	if err != nil {
+		return "", 0, err
+	}
+	if object.Size != counter.Count {
+		return "", 0, fmt.Errorf("size mismatch for %s: sent %d bytes, stored %d bytes", s3Path, counter.Count, object.Size)
 	}
 
-	// Cleaning
-	os.RemoveAll(localPath)
-	log.Info("[main.go][parseSingleAttachment] Finished with '" + localPath + "'\n")
-	return true
+	return hex.EncodeToString(hasher.Sum(nil)), counter.Count, nil
 }
 
 func setupLogger() {
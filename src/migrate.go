@@ -0,0 +1,316 @@
+package main
+
+import (
+	"app/src/api/kitsu"
+	"app/src/layout"
+	"app/src/model"
+	"app/src/storage"
+	"app/src/utils"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// migrateResult is a single line of the migration report
+type migrateResult struct {
+	Destination string
+	OldKey      string
+	NewKey      string
+	Status      string
+	Reason      string
+}
+
+func runMigrateLayout(conf utils.Config, args []string) {
+	flags := flag.NewFlagSet("migrate-layout", flag.ExitOnError)
+	dryRunFlag := flags.Bool("dry-run", false, "only print what would be moved")
+	flags.Parse(args)
+
+	ctx := context.Background()
+
+	// Auth to Kitsu to get JWT token
+	kc := openKitsu(ctx, conf)
+
+	// Connect to DB
+	db := openDB()
+
+	// Most attachments share projects and entities, load them at once
+	loadKitsuCache(conf, db, kc)
+	if err := kc.Prewarm(ctx); err != nil {
+		log.Warn("[migrate.go][runMigrateLayout] Failed to prewarm Kitsu cache: " + err.Error())
+	}
+	defer saveKitsuCache(conf, db, kc)
+
+	// Connect to storages
+	destinations := openDestinations(conf)
+
+	// Parse key layout
+	keys := openLayout(conf)
+
+	// Group uploaded copies by attachment
+	uploads := map[string][]model.Upload{}
+	var ids []string
+	for _, elem := range model.FindUploadsByStatus(db, "done") {
+		if _, ok := uploads[elem.AttachmentID]; !ok {
+			ids = append(ids, elem.AttachmentID)
+		}
+		uploads[elem.AttachmentID] = append(uploads[elem.AttachmentID], elem)
+	}
+	sort.Strings(ids)
+
+	// Work out new keys first, nothing is moved if the template gives several attachments the same key
+	var report []migrateResult
+	newKeys := map[string]string{}
+	for _, id := range ids {
+		newKey, failed := planMigration(ctx, conf, db, kc, keys, id, uploads[id])
+		if failed != nil {
+			report = append(report, failed...)
+			continue
+		}
+		newKeys[id] = newKey
+	}
+	owners := keyOwners(uploads, newKeys)
+
+	for _, id := range ids {
+		newKey, ok := newKeys[id]
+		if !ok {
+			continue
+		}
+		if others := otherOwners(owners[newKey], id); len(others) > 0 {
+			report = append(report, reportUploads(uploads[id], newKey, "failed", "key is taken by attachment "+strings.Join(others, ", "))...)
+			continue
+		}
+		report = append(report, migrateAttachment(db, destinations, id, uploads[id], newKey, *dryRunFlag)...)
+	}
+
+	printMigrateReport(report, *dryRunFlag)
+}
+
+// reportUploads reports every copy of the attachment with the same status
+func reportUploads(uploads []model.Upload, newKey, status, reason string) []migrateResult {
+	var report []migrateResult
+	for _, elem := range uploads {
+		report = append(report, migrateResult{Destination: elem.Destination, OldKey: elem.AttachmentKey, NewKey: newKey, Status: status, Reason: reason})
+	}
+	return report
+}
+
+// keyOwners maps current and new keys to attachments holding them
+func keyOwners(uploads map[string][]model.Upload, newKeys map[string]string) map[string][]string {
+	owners := map[string][]string{}
+	add := func(key, id string) {
+		for _, elem := range owners[key] {
+			if elem == id {
+				return
+			}
+		}
+		owners[key] = append(owners[key], id)
+	}
+	for id, elem := range uploads {
+		for _, upload := range elem {
+			add(upload.AttachmentKey, id)
+		}
+	}
+	for id, key := range newKeys {
+		add(key, id)
+	}
+	return owners
+}
+
+// otherOwners returns attachments other than id holding the key
+func otherOwners(owners []string, id string) []string {
+	var others []string
+	for _, elem := range owners {
+		if elem != id {
+			others = append(others, elem)
+		}
+	}
+	sort.Strings(others)
+	return others
+}
+
+// planMigration forms the key from the current template. Returns report lines instead when the key can't be formed
+func planMigration(ctx context.Context, conf utils.Config, db *gorm.DB, kc *kitsu.Client, keys *layout.Template, attachmentID string, uploads []model.Upload) (string, []migrateResult) {
+	// Kitsu metadata is needed to form the key
+	rec := model.FindAttachment(db, attachmentID)
+	attachment, err := kc.GetAttachment(ctx, attachmentID)
+	if err != nil {
+		if kitsu.IsNotFound(err) {
+			return "", reportUploads(uploads, "", "skipped", "attachment is not in Kitsu")
+		}
+		return "", reportUploads(uploads, "", "failed", err.Error())
+	}
+	if attachment.Comment.ObjectID == "" {
+		attachment.Comment.ObjectID = rec.TaskID
+	}
+
+	newKey, _, _, err := buildAttachmentKey(ctx, conf, kc, keys, attachment)
+	if err != nil {
+		return "", reportUploads(uploads, "", "failed", err.Error())
+	}
+
+	return newKey, nil
+}
+
+// migrateAttachment moves every copy of the attachment to the new key.
+// Keys are recorded right after each move so an interrupted migration picks up where it stopped
+func migrateAttachment(db *gorm.DB, destinations []storage.Destination, attachmentID string, uploads []model.Upload, newKey string, dryRun bool) []migrateResult {
+	rec := model.FindAttachment(db, attachmentID)
+
+	var report []migrateResult
+	moved := true
+	for _, upload := range uploads {
+		result := migrateResult{Destination: upload.Destination, OldKey: upload.AttachmentKey, NewKey: newKey}
+
+		if upload.AttachmentKey == newKey {
+			continue
+		}
+		if upload.AttachmentKey == "" {
+			result.Status = "skipped"
+			result.Reason = "no location recorded, run a full backup pass first"
+			report = append(report, result)
+			moved = false
+			continue
+		}
+
+		dest, ok := findDestination(destinations, upload.Destination)
+		if !ok {
+			result.Status = "failed"
+			result.Reason = "destination is not in config"
+			report = append(report, result)
+			moved = false
+			continue
+		}
+
+		if dryRun {
+			result.Status = "move"
+			report = append(report, result)
+			continue
+		}
+
+		log.Info("[migrate.go][migrateAttachment] Moving '" + upload.AttachmentKey + "' to '" + newKey + "' in '" + dest.Name + "'")
+		if err := moveObject(dest, upload, newKey); err != nil {
+			log.Error("[migrate.go][migrateAttachment] Failed to move '" + upload.AttachmentKey + "': " + err.Error())
+			result.Status = "failed"
+			result.Reason = err.Error()
+			report = append(report, result)
+			moved = false
+			continue
+		}
+		model.UpdateUploadKey(db, attachmentID, upload.Destination, newKey)
+
+		result.Status = "moved"
+		report = append(report, result)
+	}
+
+	if moved && !dryRun && rec.AttachmentKey != newKey {
+		model.UpdateAttachmentKey(db, attachmentID, newKey)
+	}
+
+	return report
+}
+
+// moveObject copies the object to the new key, checks the copy and deletes the original
+func moveObject(dest storage.Destination, upload model.Upload, newKey string) error {
+	// Size to verify the copy against, the original may be gone already after an interrupted run
+	size := upload.AttachmentSize
+	src, err := dest.Stat(upload.AttachmentKey)
+	switch {
+	case err == nil:
+		size = src.Size
+	case err == storage.ErrNotFound:
+		if err := verifyCopy(dest, newKey, size, upload.AttachmentHash); err != nil {
+			return fmt.Errorf("object not found under old key, new key: %s", err.Error())
+		}
+		return nil
+	default:
+		return err
+	}
+
+	// Never overwrite an object, a matching one is taken for the copy made by an interrupted run
+	_, err = dest.Stat(newKey)
+	switch {
+	case err == nil:
+		if err := verifyCopy(dest, newKey, size, upload.AttachmentHash); err != nil {
+			return fmt.Errorf("another object is stored under the new key: %s", err.Error())
+		}
+		return dest.Delete(upload.AttachmentKey)
+	case err != storage.ErrNotFound:
+		return err
+	}
+
+	if err := storage.Copy(dest, upload.AttachmentKey, newKey); err != nil {
+		return err
+	}
+	if err := verifyCopy(dest, newKey, size, upload.AttachmentHash); err != nil {
+		return fmt.Errorf("copy check failed: %s", err.Error())
+	}
+
+	return dest.Delete(upload.AttachmentKey)
+}
+
+// verifyCopy checks the object against the upload by size and by SHA-256 when it was recorded. Storages don't
+// report SHA-256, so the object is read back to compute it
+func verifyCopy(dest storage.Storage, key string, size int64, hash string) error {
+	object, err := dest.Stat(key)
+	if err != nil {
+		return err
+	}
+	if size != 0 && object.Size != size {
+		return fmt.Errorf("size mismatch: %d bytes instead of %d", object.Size, size)
+	}
+	if hash == "" {
+		return nil
+	}
+
+	content, err := dest.Get(key)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, content); err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(hasher.Sum(nil)); sum != hash {
+		return fmt.Errorf("hash mismatch: %s instead of %s", sum, hash)
+	}
+	return nil
+}
+
+func findDestination(destinations []storage.Destination, name string) (storage.Destination, bool) {
+	for _, elem := range destinations {
+		if elem.Name == name {
+			return elem, true
+		}
+	}
+	return storage.Destination{}, false
+}
+
+func printMigrateReport(report []migrateResult, dryRun bool) {
+	counts := map[string]int{}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "STATUS\tDESTINATION\tOLD KEY\tNEW KEY\tREASON")
+	for _, elem := range report {
+		counts[elem.Status]++
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", elem.Status, elem.Destination, elem.OldKey, elem.NewKey, elem.Reason)
+	}
+	w.Flush()
+
+	if dryRun {
+		fmt.Printf("\nDry run, would move: %d, skipped: %d, failed: %d\n", counts["move"], counts["skipped"], counts["failed"])
+		return
+	}
+	fmt.Printf("\nMoved: %d, skipped: %d, failed: %d\n", counts["moved"], counts["skipped"], counts["failed"])
+}
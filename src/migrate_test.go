@@ -0,0 +1,67 @@
+package main
+
+import (
+	"app/src/api/fs"
+	"app/src/model"
+	"app/src/storage"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestMoveObject(t *testing.T) {
+	sum := sha256.Sum256([]byte("movie"))
+	upload := model.Upload{AttachmentKey: "old/shot.mov", AttachmentSize: 5, AttachmentHash: hex.EncodeToString(sum[:])}
+
+	tests := []struct {
+		name     string
+		existing string // content already under the new key, empty for none
+		fails    bool
+	}{
+		{name: "move"},
+		{name: "copy of interrupted run", existing: "movie"},
+		{name: "other object of the same size", existing: "other", fails: true},
+		{name: "other object", existing: "another movie", fails: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := fs.NewClient(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			dest := storage.Destination{Name: "default", Storage: client}
+			if err := dest.Put(upload.AttachmentKey, strings.NewReader("movie")); err != nil {
+				t.Fatal(err)
+			}
+			if tt.existing != "" {
+				if err := dest.Put("new/shot.mov", strings.NewReader(tt.existing)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err = moveObject(dest, upload, "new/shot.mov")
+
+			_, srcErr := dest.Stat(upload.AttachmentKey)
+			if tt.fails {
+				if err == nil {
+					t.Fatal("moved onto another object")
+				}
+				if srcErr != nil {
+					t.Fatalf("source is gone: %v", srcErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if srcErr != storage.ErrNotFound {
+				t.Errorf("source is kept: %v", srcErr)
+			}
+			if err := verifyCopy(dest, "new/shot.mov", upload.AttachmentSize, upload.AttachmentHash); err != nil {
+				t.Errorf("new key: %v", err)
+			}
+		})
+	}
+}
@@ -6,6 +6,18 @@ import (
 	"gorm.io/gorm"
 )
 
+// Attachment statuses. Removed is an attachment gone from Kitsu and waiting for its copies to be deleted
+const (
+	StatusPending     = "pending"
+	StatusDownloading = "downloading"
+	StatusUploading   = "uploading"
+	StatusDone        = "done"
+	StatusFailed      = "failed"
+	StatusSkipped     = "skipped"
+	StatusRemoved     = "removed"
+	StatusDeleted     = "deleted"
+)
+
 type Task struct {
 	ID               uint `gorm:"primaryKey"`
 	CreatedAt        time.Time
@@ -26,6 +38,66 @@ type Attachment struct {
 	AttachmentID        string
 	AttachmentUpdatedAt string
 	AttachmentStatus    string
+	AttachmentName      string
+	AttachmentKey       string
+	CommentID           string
+	TaskID              string
+	ProjectName         string
+	AttachmentHash      string
+	AttachmentSize      int64
+	RemovedAt           *time.Time
+	StatusBeforeRemoval string
+	PurgedAt            *time.Time
+	LastError           string
+	Attempts            int
+	LastAttemptAt       *time.Time
+	NextAttemptAt       *time.Time
+}
+
+// Upload tracks a copy of the attachment in a single destination
+type Upload struct {
+	ID                  uint `gorm:"primaryKey"`
+	CreatedAt           time.Time
+	UpdatedAt           time.Time
+	DeletedAt           gorm.DeletedAt `gorm:"index"`
+	AttachmentID        string         `gorm:"index"`
+	Destination         string
+	AttachmentUpdatedAt string
+	AttachmentKey       string
+	AttachmentHash      string
+	AttachmentSize      int64
+	UploadStatus        string
+}
+
+// Run records a single backup pass
+type Run struct {
+	ID         uint `gorm:"primaryKey"`
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+	DeletedAt  gorm.DeletedAt `gorm:"index"`
+	StartedAt  time.Time
+	FinishedAt *time.Time
+	Trigger    string
+	FullScan   bool
+	Scanned    int
+	Uploaded   int
+	Skipped    int
+	Failed     int
+	Bytes      int64
+	Errors     int
+	LastError  string
+
+	// HighWaterMark is the latest Kitsu updated_at seen, set once listing is complete
+	HighWaterMark string
+}
+
+// KitsuObject is a persisted entry of Kitsu metadata cache
+type KitsuObject struct {
+	ID              uint   `gorm:"primaryKey"`
+	ObjectPath      string `gorm:"uniqueIndex"`
+	ObjectUpdatedAt string
+	Data            []byte
+	ExpiresAt       time.Time
 }
 
 func CreateTask(db *gorm.DB, taskID, taskUpdatedAt, taskStatus, commentID, commentUpdatedAt string) {
@@ -61,8 +133,290 @@ func UpdateAttachment(db *gorm.DB, attachmentID, attachmentUpdatedAt, attachment
 	db.Save(&rec)
 }
 
+// StartAttachment creates or moves the attachment to pending, attempts start over for a new version
+func StartAttachment(db *gorm.DB, attachmentID, attachmentUpdatedAt string) {
+	var rec Attachment
+	db.Where("attachment_id=?", attachmentID).Find(&rec)
+	if rec.AttachmentUpdatedAt != attachmentUpdatedAt {
+		rec.Attempts = 0
+	}
+	now := time.Now()
+	rec.AttachmentID = attachmentID
+	rec.AttachmentUpdatedAt = attachmentUpdatedAt
+	rec.AttachmentStatus = StatusPending
+	rec.LastAttemptAt = &now
+
+	db.Save(&rec)
+}
+
+// ResetInterruptedAttachments moves attachments stopped midway back to pending
+func ResetInterruptedAttachments(db *gorm.DB) {
+	db.Model(&Attachment{}).Where("attachment_status IN ?", []string{StatusDownloading, StatusUploading}).Update("attachment_status", StatusPending)
+}
+
+// SetAttachmentStatus moves the attachment to the next stage of the backup
+func SetAttachmentStatus(db *gorm.DB, attachmentID, attachmentStatus string) {
+	db.Model(&Attachment{}).Where("attachment_id=?", attachmentID).Update("attachment_status", attachmentStatus)
+}
+
+// FinishAttachment marks the attachment as done and clears failures
+func FinishAttachment(db *gorm.DB, attachmentID string) {
+	var rec Attachment
+	db.Where("attachment_id=?", attachmentID).Find(&rec)
+	rec.AttachmentStatus = StatusDone
+	rec.LastError = ""
+	rec.Attempts = 0
+	rec.NextAttemptAt = nil
+
+	db.Save(&rec)
+}
+
+// FailAttachment records the failure, the attachment is not tried again until nextAttemptAt
+func FailAttachment(db *gorm.DB, attachmentID, lastError string, nextAttemptAt time.Time) {
+	var rec Attachment
+	db.Where("attachment_id=?", attachmentID).Find(&rec)
+	rec.AttachmentStatus = StatusFailed
+	rec.LastError = lastError
+	rec.Attempts++
+	rec.NextAttemptAt = &nextAttemptAt
+
+	db.Save(&rec)
+}
+
+// SkipAttachment records the attachment which is not backed up on purpose
+func SkipAttachment(db *gorm.DB, attachmentID, attachmentUpdatedAt, reason string) {
+	var rec Attachment
+	db.Where("attachment_id=?", attachmentID).Find(&rec)
+	rec.AttachmentID = attachmentID
+	rec.AttachmentUpdatedAt = attachmentUpdatedAt
+	rec.AttachmentStatus = StatusSkipped
+	rec.LastError = reason
+
+	db.Save(&rec)
+}
+
+// UpdateAttachmentLocation remembers where the attachment was backed up and where it belongs in Kitsu
+func UpdateAttachmentLocation(db *gorm.DB, attachmentID, attachmentName, attachmentKey, commentID, taskID, projectName string) {
+	var rec Attachment
+	db.Where("attachment_id=?", attachmentID).Find(&rec)
+	rec.AttachmentName = attachmentName
+	rec.AttachmentKey = attachmentKey
+	rec.CommentID = commentID
+	rec.TaskID = taskID
+	rec.ProjectName = projectName
+
+	db.Save(&rec)
+}
+
+// UpdateAttachmentChecksum stores SHA-256 and size of the uploaded content
+func UpdateAttachmentChecksum(db *gorm.DB, attachmentID, attachmentHash string, attachmentSize int64) {
+	var rec Attachment
+	db.Where("attachment_id=?", attachmentID).Find(&rec)
+	rec.AttachmentHash = attachmentHash
+	rec.AttachmentSize = attachmentSize
+
+	db.Save(&rec)
+}
+
+// FindKnownAttachmentIDs returns IDs of every attachment recorded before the given time which may have copies not deleted yet
+func FindKnownAttachmentIDs(db *gorm.DB, before time.Time) []string {
+	var ids []string
+	db.Model(&Attachment{}).Where("attachment_status NOT IN ? AND created_at < ?", []string{StatusDeleted, StatusSkipped}, before).Pluck("attachment_id", &ids)
+	return ids
+}
+
+func FindAttachmentIDsByStatus(db *gorm.DB, attachmentStatus string) []string {
+	var ids []string
+	db.Model(&Attachment{}).Where("attachment_status = ?", attachmentStatus).Pluck("attachment_id", &ids)
+	return ids
+}
+
+// FindAttachmentIDsByTasks returns attachments known to belong to the tasks
+func FindAttachmentIDsByTasks(db *gorm.DB, taskIDs []string) []string {
+	var ids []string
+	if len(taskIDs) == 0 {
+		return ids
+	}
+	db.Model(&Attachment{}).Where("task_id IN ? AND attachment_status NOT IN ?", taskIDs, []string{StatusRemoved, StatusDeleted}).Pluck("attachment_id", &ids)
+	return ids
+}
+
+// FindAttachmentIDsToRetry returns unfinished attachments and failed ones whose next attempt is due
+func FindAttachmentIDsToRetry(db *gorm.DB, now time.Time) []string {
+	var ids []string
+	db.Model(&Attachment{}).
+		Where("attachment_status IN ?", []string{StatusPending, StatusDownloading, StatusUploading}).
+		Or("attachment_status = ? AND (next_attempt_at IS NULL OR next_attempt_at <= ?)", StatusFailed, now).
+		Pluck("attachment_id", &ids)
+	return ids
+}
+
+// MarkAttachmentRemoved remembers when the attachment disappeared from Kitsu
+func MarkAttachmentRemoved(db *gorm.DB, attachmentID string, removedAt time.Time) {
+	var rec Attachment
+	db.Where("attachment_id=?", attachmentID).Find(&rec)
+	if rec.AttachmentStatus != StatusRemoved {
+		rec.StatusBeforeRemoval = rec.AttachmentStatus
+	}
+	rec.AttachmentStatus = StatusRemoved
+	rec.RemovedAt = &removedAt
+
+	db.Save(&rec)
+}
+
+// UnmarkAttachmentRemoved brings back the attachment which showed up in Kitsu again with the status it had before.
+// Attachments removed before that status was kept go back to pending to have their uploads checked
+func UnmarkAttachmentRemoved(db *gorm.DB, attachmentID string) {
+	var rec Attachment
+	db.Where("attachment_id=?", attachmentID).Find(&rec)
+	rec.AttachmentStatus = rec.StatusBeforeRemoval
+	if rec.AttachmentStatus == "" {
+		rec.AttachmentStatus = StatusPending
+	}
+	rec.StatusBeforeRemoval = ""
+	rec.RemovedAt = nil
+
+	db.Save(&rec)
+}
+
+// MarkAttachmentPurged records deletion of the attachment copies
+func MarkAttachmentPurged(db *gorm.DB, attachmentID string, purgedAt time.Time) {
+	var rec Attachment
+	db.Where("attachment_id=?", attachmentID).Find(&rec)
+	rec.AttachmentStatus = StatusDeleted
+	rec.PurgedAt = &purgedAt
+
+	db.Save(&rec)
+}
+
+// FindAttachments returns backed up attachments including removed ones still kept, optionally narrowed to a project and/or a list of IDs
+func FindAttachments(db *gorm.DB, projectName string, attachmentIDs []string) []Attachment {
+	var Attachments []Attachment
+	query := db.Where("attachment_status IN ?", []string{StatusDone, StatusRemoved})
+	if projectName != "" {
+		query = query.Where("project_name = ?", projectName)
+	}
+	if len(attachmentIDs) > 0 {
+		query = query.Where("attachment_id IN ?", attachmentIDs)
+	}
+	query.Find(&Attachments)
+	return Attachments
+}
+
 func FindAttachment(db *gorm.DB, attachmentID string) Attachment {
 	var Attachment Attachment
 	db.First(&Attachment, "attachment_id = ?", attachmentID) // find product with code D42
 	return Attachment
 }
+
+// SaveUpload creates or updates status of the attachment copy in the destination
+func SaveUpload(db *gorm.DB, attachmentID, destination, attachmentUpdatedAt, attachmentKey, attachmentHash string, attachmentSize int64, uploadStatus string) {
+	var rec Upload
+	db.Where("attachment_id=? AND destination=?", attachmentID, destination).Find(&rec)
+	rec.AttachmentID = attachmentID
+	rec.Destination = destination
+	rec.AttachmentUpdatedAt = attachmentUpdatedAt
+	rec.AttachmentKey = attachmentKey
+	rec.AttachmentHash = attachmentHash
+	rec.AttachmentSize = attachmentSize
+	rec.UploadStatus = uploadStatus
+
+	db.Save(&rec)
+}
+
+func FindUpload(db *gorm.DB, attachmentID, destination string) Upload {
+	var Upload Upload
+	db.First(&Upload, "attachment_id = ? AND destination = ?", attachmentID, destination)
+	return Upload
+}
+
+func FindUploads(db *gorm.DB, attachmentID string) []Upload {
+	var Uploads []Upload
+	db.Where("attachment_id = ?", attachmentID).Find(&Uploads)
+	return Uploads
+}
+
+func UpdateUploadStatus(db *gorm.DB, attachmentID, destination, uploadStatus string) {
+	var rec Upload
+	db.Where("attachment_id=? AND destination=?", attachmentID, destination).Find(&rec)
+	rec.UploadStatus = uploadStatus
+
+	db.Save(&rec)
+}
+
+// UpdateUploadKey records the new location of the attachment copy
+func UpdateUploadKey(db *gorm.DB, attachmentID, destination, attachmentKey string) {
+	db.Model(&Upload{}).Where("attachment_id=? AND destination=?", attachmentID, destination).Update("attachment_key", attachmentKey)
+}
+
+// UpdateAttachmentKey records the new location of the attachment once every copy is moved
+func UpdateAttachmentKey(db *gorm.DB, attachmentID, attachmentKey string) {
+	db.Model(&Attachment{}).Where("attachment_id=?", attachmentID).Update("attachment_key", attachmentKey)
+}
+
+func FindUploadsByStatus(db *gorm.DB, uploadStatus string) []Upload {
+	var Uploads []Upload
+	db.Where("upload_status = ?", uploadStatus).Find(&Uploads)
+	return Uploads
+}
+
+// FindAttachmentProjects maps attachment IDs to names of their projects
+func FindAttachmentProjects(db *gorm.DB) map[string]string {
+	var Attachments []Attachment
+	db.Select("attachment_id", "project_name").Find(&Attachments)
+
+	projects := make(map[string]string, len(Attachments))
+	for _, elem := range Attachments {
+		projects[elem.AttachmentID] = elem.ProjectName
+	}
+	return projects
+}
+
+// CreateRun records start of the backup pass
+func CreateRun(db *gorm.DB, trigger string, full bool, startedAt time.Time) Run {
+	run := Run{Trigger: trigger, FullScan: full, StartedAt: startedAt}
+	db.Create(&run)
+	return run
+}
+
+func SaveRun(db *gorm.DB, run *Run) {
+	db.Save(run)
+}
+
+// FindLastScan returns the latest run which listed Kitsu completely, full scans only if asked
+func FindLastScan(db *gorm.DB, full bool) Run {
+	var run Run
+	query := db.Where("finished_at IS NOT NULL AND high_water_mark <> ''")
+	if full {
+		query = query.Where("full_scan = ?", true)
+	}
+	query.Order("started_at desc").Limit(1).Find(&run)
+	return run
+}
+
+// FindRuns returns the last runs, newest first
+func FindRuns(db *gorm.DB, limit int) []Run {
+	var Runs []Run
+	db.Order("started_at desc").Limit(limit).Find(&Runs)
+	return Runs
+}
+
+// FindKitsuObjects returns persisted metadata cache entries which are not expired
+func FindKitsuObjects(db *gorm.DB, now time.Time) []KitsuObject {
+	var Objects []KitsuObject
+	db.Where("expires_at > ?", now).Find(&Objects)
+	return Objects
+}
+
+// ReplaceKitsuObjects persists metadata cache in place of the previous one
+func ReplaceKitsuObjects(db *gorm.DB, objects []KitsuObject) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("1 = 1").Delete(&KitsuObject{}).Error; err != nil {
+			return err
+		}
+		if len(objects) == 0 {
+			return nil
+		}
+		return tx.CreateInBatches(objects, 500).Error
+	})
+}
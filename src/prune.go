@@ -0,0 +1,210 @@
+package main
+
+import (
+	"app/src/api/kitsu"
+	"app/src/model"
+	"app/src/storage"
+	"app/src/utils"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// pruneVersion is a single uploaded version of a file in a destination
+type pruneVersion struct {
+	Upload  model.Upload
+	Project string
+	Time    time.Time
+	Keep    bool
+	Reason  string
+}
+
+func runPrune(conf utils.Config, args []string) {
+	flags := flag.NewFlagSet("prune", flag.ExitOnError)
+	dryRunFlag := flags.Bool("dry-run", false, "only print what would be deleted")
+	flags.Parse(args)
+
+	retention := conf.Backup.Retention
+	if retention.KeepLast <= 0 && retention.KeepDaily <= 0 && retention.KeepMonthly <= 0 {
+		log.Error("[prune.go][runPrune] No retention rules set in [backup.retention], nothing to prune")
+		os.Exit(1)
+	}
+
+	// Connect to DB
+	db := openDB()
+
+	// Projects which must be kept whole
+	keepProjects := map[string]bool{}
+	if len(retention.KeepProjectStatuses) > 0 {
+		ctx := context.Background()
+		var err error
+		keepProjects, err = projectsWithStatus(ctx, openKitsu(ctx, conf), retention.KeepProjectStatuses)
+		if err != nil {
+			log.Error("[prune.go][runPrune] Failed to get project statuses from Kitsu: " + err.Error())
+			os.Exit(1)
+		}
+	}
+
+	// Group uploaded versions by destination and path without timestamp
+	projects := model.FindAttachmentProjects(db)
+	groups := map[string][]*pruneVersion{}
+	for _, elem := range model.FindUploadsByStatus(db, "done") {
+		stripped, stamp := splitTimestamp(elem.AttachmentKey)
+		versionTime, err := time.Parse("2006-01-02T15-04-05", stamp)
+		if err != nil {
+			versionTime = elem.CreatedAt
+		}
+
+		group := elem.Destination + ":" + stripped
+		groups[group] = append(groups[group], &pruneVersion{
+			Upload:  elem,
+			Project: projects[elem.AttachmentID],
+			Time:    versionTime,
+		})
+	}
+
+	// Apply rules
+	now := time.Now()
+	var report []*pruneVersion
+	for _, versions := range groups {
+		applyRetention(retention.KeepLast, retention.KeepDaily, retention.KeepMonthly, keepProjects, versions, now)
+		report = append(report, versions...)
+	}
+	keepSharedKeys(report)
+	sort.Slice(report, func(i, j int) bool {
+		return report[i].Upload.AttachmentKey < report[j].Upload.AttachmentKey
+	})
+
+	// Delete
+	if !*dryRunFlag {
+		destinations := openDestinations(conf)
+		for _, elem := range report {
+			if elem.Keep {
+				continue
+			}
+			if err := deleteVersion(destinations, elem.Upload); err != nil {
+				log.Error("[prune.go][runPrune] Failed to delete '" + elem.Upload.AttachmentKey + "': " + err.Error())
+				elem.Keep = true
+				elem.Reason = "delete failed: " + err.Error()
+				continue
+			}
+			model.UpdateUploadStatus(db, elem.Upload.AttachmentID, elem.Upload.Destination, "pruned")
+		}
+	}
+
+	printPruneReport(report, *dryRunFlag)
+}
+
+// applyRetention marks versions of a single file to keep, a version is kept when any rule keeps it
+func applyRetention(keepLast, keepDaily, keepMonthly int, keepProjects map[string]bool, versions []*pruneVersion, now time.Time) {
+	// Newest first
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].Time.After(versions[j].Time)
+	})
+
+	days := map[string]bool{}
+	months := map[string]bool{}
+	for i, elem := range versions {
+		switch {
+		case i == 0:
+			elem.Keep, elem.Reason = true, "newest"
+		case keepProjects[elem.Project]:
+			elem.Keep, elem.Reason = true, "project status"
+		case i < keepLast:
+			elem.Keep, elem.Reason = true, "last"
+		case keepDaily > 0 && elem.Time.After(now.AddDate(0, 0, -keepDaily)) && !days[elem.Time.Format("2006-01-02")]:
+			elem.Keep, elem.Reason = true, "daily"
+		case keepMonthly > 0 && elem.Time.After(now.AddDate(0, -keepMonthly, 0)) && !months[elem.Time.Format("2006-01")]:
+			elem.Keep, elem.Reason = true, "monthly"
+		default:
+			elem.Reason = "superseded"
+		}
+
+		// Newer versions take the day and month slot first
+		days[elem.Time.Format("2006-01-02")] = true
+		months[elem.Time.Format("2006-01")] = true
+	}
+}
+
+// keepSharedKeys keeps versions stored under the same key as a kept one in the same destination, deleting the object
+// would take the kept version with it. Keys are shared when the layout has no timestamp or versions came within a second
+func keepSharedKeys(report []*pruneVersion) {
+	kept := map[string]bool{}
+	for _, elem := range report {
+		if elem.Keep {
+			kept[elem.Upload.Destination+":"+elem.Upload.AttachmentKey] = true
+		}
+	}
+
+	for _, elem := range report {
+		if !elem.Keep && kept[elem.Upload.Destination+":"+elem.Upload.AttachmentKey] {
+			elem.Keep, elem.Reason = true, "key shared with kept version"
+		}
+	}
+}
+
+// projectsWithStatus returns sanitized names of Kitsu projects with one of the given statuses
+func projectsWithStatus(ctx context.Context, kc *kitsu.Client, statuses []string) (map[string]bool, error) {
+	wanted := map[string]bool{}
+	for _, elem := range statuses {
+		wanted[elem] = true
+	}
+
+	all, err := kc.GetProjects(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	projects := map[string]bool{}
+	for _, elem := range all.Each {
+		status, err := kc.GetProjectStatus(ctx, elem.ProjectStatusID)
+		if err != nil {
+			return nil, err
+		}
+		if wanted[status.Name] {
+			projects[utils.SanitizeString(elem.Name)] = true
+		}
+	}
+	return projects, nil
+}
+
+func deleteVersion(destinations []storage.Destination, upload model.Upload) error {
+	for _, dest := range destinations {
+		if dest.Name == upload.Destination {
+			return dest.Delete(upload.AttachmentKey)
+		}
+	}
+	return fmt.Errorf("destination '%s' is not in config", upload.Destination)
+}
+
+func printPruneReport(report []*pruneVersion, dryRun bool) {
+	var kept, deleted int
+	var freed int64
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ACTION\tDESTINATION\tKEY\tREASON")
+	for _, elem := range report {
+		action := "keep"
+		if !elem.Keep {
+			action = "delete"
+			deleted++
+			freed += elem.Upload.AttachmentSize
+		} else {
+			kept++
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", action, elem.Upload.Destination, elem.Upload.AttachmentKey, elem.Reason)
+	}
+	w.Flush()
+
+	if dryRun {
+		fmt.Printf("\nDry run, nothing deleted. Would keep: %d, delete: %d (%d bytes)\n", kept, deleted, freed)
+		return
+	}
+	fmt.Printf("\nKept: %d, deleted: %d (%d bytes)\n", kept, deleted, freed)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"app/src/model"
+	"testing"
+	"time"
+)
+
+func TestApplyRetention(t *testing.T) {
+	now := time.Date(2022, 3, 15, 12, 0, 0, 0, time.UTC)
+	at := func(days, hours int) time.Time {
+		return now.AddDate(0, 0, -days).Add(-time.Duration(hours) * time.Hour)
+	}
+
+	tests := []struct {
+		name         string
+		keepLast     int
+		keepDaily    int
+		keepMonthly  int
+		keepProjects map[string]bool
+		project      string
+		times        []time.Time
+		reasons      []string // per version, newest first
+	}{
+		{
+			name:    "newest only",
+			times:   []time.Time{at(3, 0), at(0, 0), at(1, 0)},
+			reasons: []string{"newest", "superseded", "superseded"},
+		},
+		{
+			name:     "last",
+			keepLast: 2,
+			times:    []time.Time{at(0, 0), at(1, 0), at(2, 0)},
+			reasons:  []string{"newest", "last", "superseded"},
+		},
+		{
+			name:      "daily keeps newest version of each day",
+			keepDaily: 3,
+			times:     []time.Time{at(0, 0), at(0, 1), at(1, 0), at(1, 1), at(5, 0)},
+			reasons:   []string{"newest", "superseded", "daily", "superseded", "superseded"},
+		},
+		{
+			name:        "monthly",
+			keepMonthly: 2,
+			times:       []time.Time{at(0, 0), at(20, 0), at(21, 0), at(120, 0)},
+			reasons:     []string{"newest", "monthly", "superseded", "superseded"},
+		},
+		{
+			name:         "project status keeps everything",
+			keepProjects: map[string]bool{"Archived": true},
+			project:      "Archived",
+			times:        []time.Time{at(0, 0), at(40, 0)},
+			reasons:      []string{"newest", "project status"},
+		},
+		{
+			name:         "other projects are pruned",
+			keepProjects: map[string]bool{"Archived": true},
+			project:      "Active",
+			times:        []time.Time{at(0, 0), at(40, 0)},
+			reasons:      []string{"newest", "superseded"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var versions []*pruneVersion
+			for _, elem := range tt.times {
+				versions = append(versions, &pruneVersion{Project: tt.project, Time: elem})
+			}
+
+			applyRetention(tt.keepLast, tt.keepDaily, tt.keepMonthly, tt.keepProjects, versions, now)
+
+			for i, elem := range versions {
+				if i > 0 && elem.Time.After(versions[i-1].Time) {
+					t.Fatalf("versions are not sorted newest first")
+				}
+				if elem.Reason != tt.reasons[i] {
+					t.Errorf("version %d (%s): reason %q, want %q", i, elem.Time.Format(time.RFC3339), elem.Reason, tt.reasons[i])
+				}
+				if keep := elem.Reason != "superseded"; elem.Keep != keep {
+					t.Errorf("version %d: keep %v, want %v", i, elem.Keep, keep)
+				}
+			}
+		})
+	}
+}
+
+func TestKeepSharedKeys(t *testing.T) {
+	version := func(destination, key string, keep bool) *pruneVersion {
+		return &pruneVersion{Upload: model.Upload{Destination: destination, AttachmentKey: key}, Keep: keep}
+	}
+	report := []*pruneVersion{
+		version("default", "project/shot.mov", true),
+		version("default", "project/shot.mov", false),
+		version("offsite", "project/shot.mov", false),
+		version("default", "project/shot_2022-03-01T10-20-30.mov", false),
+	}
+
+	keepSharedKeys(report)
+
+	for i, want := range []bool{true, true, false, false} {
+		if report[i].Keep != want {
+			t.Errorf("version %d (%s %s): keep %v, want %v", i, report[i].Upload.Destination, report[i].Upload.AttachmentKey, report[i].Keep, want)
+		}
+	}
+}
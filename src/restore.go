@@ -0,0 +1,210 @@
+package main
+
+import (
+	"app/src/api/kitsu"
+	"app/src/model"
+	"app/src/storage"
+	"app/src/utils"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// restoreResult is a single line of the restore report
+type restoreResult struct {
+	AttachmentID string
+	Key          string
+	Status       string
+	Reason       string
+}
+
+func runRestore(conf utils.Config, args []string) {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	projectFlag := flags.String("project", "", "restore attachments of this Kitsu project only")
+	idFlag := flags.String("id", "", "comma separated list of attachment IDs to restore")
+	forceFlag := flags.Bool("force", false, "restore even if the attachment still exists in Kitsu")
+	fromFlag := flags.String("from", "", "name of the destination to read backups from, the first one by default")
+	flags.Parse(args)
+
+	ctx := context.Background()
+
+	// Auth to Kitsu to get JWT token
+	kc := openKitsu(ctx, conf)
+
+	// Connect to DB
+	db := openDB()
+
+	// Connect to storage
+	store := pickDestination(openDestinations(conf), *fromFlag)
+
+	// Prepare filters
+	projectName := utils.SanitizeString(*projectFlag)
+	var attachmentIDs []string
+	for _, elem := range strings.Split(*idFlag, ",") {
+		if id := strings.TrimSpace(elem); id != "" {
+			attachmentIDs = append(attachmentIDs, id)
+		}
+	}
+
+	// Get objects stored in the bucket
+	prefix := conf.Backup.S3.RootFolderName + "/"
+	if projectName != "" {
+		prefix = prefix + projectName + "/"
+	}
+	log.Info("[restore.go][runRestore] Listing objects under '" + prefix + "'")
+	objects, err := store.List(prefix)
+	if err != nil {
+		log.Error("[restore.go][runRestore] Failed to list objects: " + err.Error())
+		os.Exit(1)
+	}
+	stored := make(map[string]bool, len(objects))
+	for _, elem := range objects {
+		stored[elem.Key] = true
+	}
+
+	// Match objects to the attachments recorded in DB. Attachments of a deleted comment go to a single new one
+	var report []restoreResult
+	recreated := map[string]string{}
+	for _, elem := range model.FindAttachments(db, projectName, attachmentIDs) {
+		key := restoreKey(db, store.Name, elem)
+		result := restoreSingleAttachment(ctx, kc, store, elem, key, stored, recreated, *forceFlag)
+		report = append(report, result)
+
+		// Kitsu gives the restored file a new ID, the old backup is kept for another grace period until it's backed up
+		if result.Status == "restored" && elem.AttachmentStatus == model.StatusRemoved {
+			model.MarkAttachmentRemoved(db, elem.AttachmentID, time.Now())
+		}
+	}
+
+	printRestoreReport(report)
+}
+
+// restoreKey returns where the destination holds the attachment. Keys may differ between destinations and change
+// with migrate-layout, the attachment's own key is used for uploads recorded before keys were kept per destination
+func restoreKey(db *gorm.DB, destination string, attachment model.Attachment) string {
+	if key := model.FindUpload(db, attachment.AttachmentID, destination).AttachmentKey; key != "" {
+		return key
+	}
+	return attachment.AttachmentKey
+}
+
+func restoreSingleAttachment(ctx context.Context, kc *kitsu.Client, store storage.Storage, attachment model.Attachment, key string, stored map[string]bool, recreated map[string]string, force bool) restoreResult {
+	result := restoreResult{AttachmentID: attachment.AttachmentID, Key: key}
+
+	if key == "" || attachment.CommentID == "" || attachment.TaskID == "" {
+		result.Status = "skipped"
+		result.Reason = "no location recorded, back it up again first"
+		return result
+	}
+	if !stored[key] {
+		// Custom path templates may put the project elsewhere than under the listed prefix
+		if _, err := store.Stat(key); err != nil {
+			result.Status = "failed"
+			result.Reason = "object not found in bucket"
+			return result
+		}
+	}
+
+	// Don't duplicate attachments that are still in place
+	if !force {
+		_, err := kc.GetAttachment(ctx, attachment.AttachmentID)
+		if err == nil {
+			result.Status = "skipped"
+			result.Reason = "attachment still exists in Kitsu"
+			return result
+		}
+		if !kitsu.IsNotFound(err) {
+			result.Status = "failed"
+			result.Reason = err.Error()
+			return result
+		}
+	}
+
+	// The file goes back to its comment, a new one is posted on the task if the comment is gone
+	commentID, err := restoreComment(ctx, kc, attachment, recreated)
+	if err != nil {
+		result.Status = "failed"
+		result.Reason = err.Error()
+		return result
+	}
+	if commentID != attachment.CommentID {
+		result.Reason = "attached to new comment " + commentID
+	}
+
+	log.Info("[restore.go][restoreSingleAttachment] Restoring '" + key + "'")
+	content, err := store.Get(key)
+	if err != nil {
+		result.Status = "failed"
+		result.Reason = err.Error()
+		return result
+	}
+	defer content.Close()
+
+	err = kc.UploadAttachment(ctx, attachment.TaskID, commentID, attachment.AttachmentName, content)
+	if err != nil {
+		result.Status = "failed"
+		result.Reason = err.Error()
+		return result
+	}
+
+	result.Status = "restored"
+	return result
+}
+
+// restoreComment returns the comment to attach the file to. When the original comment was deleted
+// a new one is posted on the task, once for all attachments of that comment
+func restoreComment(ctx context.Context, kc *kitsu.Client, attachment model.Attachment, recreated map[string]string) (string, error) {
+	if commentID, ok := recreated[attachment.CommentID]; ok {
+		return commentID, nil
+	}
+
+	_, err := kc.GetCommentByID(ctx, attachment.CommentID)
+	if err == nil {
+		return attachment.CommentID, nil
+	}
+	if !kitsu.IsNotFound(err) {
+		return "", err
+	}
+
+	task, err := kc.GetTask(ctx, attachment.TaskID)
+	if err != nil {
+		if kitsu.IsNotFound(err) {
+			return "", fmt.Errorf("comment %s and task %s not found in Kitsu", attachment.CommentID, attachment.TaskID)
+		}
+		return "", err
+	}
+
+	log.Info("[restore.go][restoreComment] Comment " + attachment.CommentID + " is gone, posting a new one on task " + task.ID)
+	comment, err := kc.CreateComment(ctx, task.ID, task.TaskStatusID, "Restored from backup")
+	if err != nil {
+		return "", err
+	}
+	if comment.ID == "" {
+		return "", fmt.Errorf("Kitsu returned no ID for the new comment on task %s", task.ID)
+	}
+	recreated[attachment.CommentID] = comment.ID
+
+	return comment.ID, nil
+}
+
+func printRestoreReport(report []restoreResult) {
+	counts := map[string]int{}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "STATUS\tATTACHMENT\tKEY\tREASON")
+	for _, elem := range report {
+		counts[elem.Status]++
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", elem.Status, elem.AttachmentID, elem.Key, elem.Reason)
+		log.Info("[restore.go][printRestoreReport] " + elem.Status + " " + elem.AttachmentID + " " + elem.Reason)
+	}
+	w.Flush()
+
+	fmt.Printf("\nRestored: %d, skipped: %d, failed: %d\n", counts["restored"], counts["skipped"], counts["failed"])
+}
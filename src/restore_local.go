@@ -0,0 +1,131 @@
+package main
+
+import (
+	"app/src/storage"
+	"app/src/utils"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Matches the "_<created_at>" postfix added to every key in parseSingleAttachment
+var timestampPostfix = regexp.MustCompile(`^(.*)_(\d{4}-\d{2}-\d{2}T\d{2}-\d{2}-\d{2}(?:\.\d+)?)(\.[^.]*)?$`)
+
+// splitTimestamp cuts the "_<created_at>" postfix from a key, returns the key without it and the timestamp itself
+func splitTimestamp(key string) (string, string) {
+	dir, file := path.Split(key)
+	match := timestampPostfix.FindStringSubmatch(file)
+	if match == nil {
+		return key, ""
+	}
+	return dir + match[1] + match[3], match[2]
+}
+
+func runRestoreLocal(conf utils.Config, args []string) {
+	flags := flag.NewFlagSet("restore-local", flag.ExitOnError)
+	projectFlag := flags.String("project", "", "Kitsu project to download (required)")
+	destFlag := flags.String("dest", "./restore/", "local folder to download to")
+	stripFlag := flags.Bool("strip-timestamp", false, "remove the _<created_at> postfix from file names, implies -latest")
+	latestFlag := flags.Bool("latest", false, "keep only the latest version of each file")
+	fromFlag := flags.String("from", "", "name of the destination to read backups from, the first one by default")
+	flags.Parse(args)
+
+	if *projectFlag == "" {
+		fmt.Println("Usage: app restore-local -project NAME [-dest DIR] [-from DESTINATION] [-strip-timestamp] [-latest]")
+		os.Exit(1)
+	}
+
+	// Versions of a file share the stripped name, only the latest one can be kept
+	if *stripFlag && !*latestFlag {
+		log.Info("[restore_local.go][runRestoreLocal] -strip-timestamp implies -latest, older versions are not downloaded")
+		*latestFlag = true
+	}
+
+	// Connect to storage
+	store := pickDestination(openDestinations(conf), *fromFlag)
+
+	// Get objects stored under the project prefix
+	root := conf.Backup.S3.RootFolderName + "/"
+	prefix := root + utils.SanitizeString(*projectFlag) + "/"
+	log.Info("[restore_local.go][runRestoreLocal] Listing objects under '" + prefix + "'")
+	objects, err := store.List(prefix)
+	if err != nil {
+		log.Error("[restore_local.go][runRestoreLocal] Failed to list objects: " + err.Error())
+		os.Exit(1)
+	}
+
+	// Pick versions to download, only the newest per stripped path when requested
+	type version struct {
+		key     string
+		relPath string
+		stamp   string
+	}
+	var selected []version
+	newest := map[string]version{}
+	for _, elem := range objects {
+		relPath := strings.TrimPrefix(elem.Key, root)
+		stripped, stamp := splitTimestamp(relPath)
+		current := version{key: elem.Key, relPath: relPath, stamp: stamp}
+
+		if !*latestFlag {
+			selected = append(selected, current)
+			continue
+		}
+		if found, ok := newest[stripped]; ok && found.stamp >= stamp {
+			continue
+		}
+		newest[stripped] = current
+	}
+	for _, elem := range newest {
+		selected = append(selected, elem)
+	}
+
+	// Download
+	var count, failed int
+	for _, elem := range selected {
+		localPath := elem.relPath
+		if *stripFlag {
+			localPath, _ = splitTimestamp(localPath)
+		}
+
+		err := downloadToLocal(store, elem.key, filepath.Join(*destFlag, filepath.FromSlash(localPath)))
+		if err != nil {
+			log.Error("[restore_local.go][runRestoreLocal] Failed to download '" + elem.key + "': " + err.Error())
+			failed++
+			continue
+		}
+		count++
+	}
+
+	fmt.Printf("Downloaded: %d, failed: %d, into '%s'\n", count, failed, *destFlag)
+}
+
+func downloadToLocal(store storage.Storage, key, localPath string) error {
+	log.Info("[restore_local.go][downloadToLocal] Downloading '" + key + "' to '" + localPath + "'")
+
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return err
+	}
+
+	content, err := store.Get(key)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	out, err := os.Create(localPath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, content)
+	return err
+}
@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestSplitTimestamp(t *testing.T) {
+	tests := []struct {
+		key      string
+		stripped string
+		stamp    string
+	}{
+		{"project/shots/sq01/sh010/Animation/file_2022-03-01T10-20-30.mov", "project/shots/sq01/sh010/Animation/file.mov", "2022-03-01T10-20-30"},
+		{"project/file_2022-03-01T10-20-30.123456.mov", "project/file.mov", "2022-03-01T10-20-30.123456"},
+		{"project/file_2022-03-01T10-20-30", "project/file", "2022-03-01T10-20-30"},
+		{"project/file.mov", "project/file.mov", ""},
+		{"project/file_2022-03-01.mov", "project/file_2022-03-01.mov", ""},
+		{"project/2022-03-01T10-20-30_dir/file.mov", "project/2022-03-01T10-20-30_dir/file.mov", ""},
+	}
+
+	for _, tt := range tests {
+		stripped, stamp := splitTimestamp(tt.key)
+		if stripped != tt.stripped || stamp != tt.stamp {
+			t.Errorf("splitTimestamp(%q) = %q, %q, want %q, %q", tt.key, stripped, stamp, tt.stripped, tt.stamp)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"app/src/api/kitsu"
+	"app/src/model"
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// kitsuTime is the layout of Kitsu timestamps
+const kitsuTime = "2006-01-02T15:04:05"
+
+// scanOverlap is how far back an incremental scan looks past the high-water mark, objects saved within the
+// same second as the mark are not missed
+const scanOverlap = time.Minute
+
+// errFilterIgnored is Kitsu returning objects older than asked for, listing changes would cost more than a full scan
+var errFilterIgnored = errors.New("Kitsu ignores updated_at filter")
+
+// scanSince returns high-water mark to list changes from, empty when a full scan is due
+func (e *engine) scanSince() string {
+	interval := time.Duration(e.conf.Backup.FullScanInterval) * time.Hour
+	if interval <= 0 || atomic.LoadInt32(&e.fullOnly) != 0 {
+		return ""
+	}
+
+	full := model.FindLastScan(e.db, true)
+	if full.ID == 0 || time.Since(full.StartedAt) >= interval {
+		return ""
+	}
+
+	return model.FindLastScan(e.db, false).HighWaterMark
+}
+
+// scanAll lists every attachment in Kitsu. Returns their IDs and the latest updated_at
+func (e *engine) scanAll(ctx context.Context, enqueue func(kitsu.Attachment) bool) ([]string, string, error) {
+	var ids []string
+	var mark string
+
+	pager := e.kc.AttachmentPager()
+	for {
+		var page []kitsu.Attachment
+		if !pager.Next(ctx, &page) {
+			break
+		}
+		for _, elem := range page {
+			ids = append(ids, elem.ID)
+			if elem.UpdatedAt > mark {
+				mark = elem.UpdatedAt
+			}
+			if !enqueue(elem) {
+				return ids, mark, nil
+			}
+		}
+	}
+
+	return ids, mark, pager.Err()
+}
+
+// scanChanged lists attachments changed since the mark, attachments of changed comments and tasks, and those
+// due for retry. Returns the new high-water mark. Attachments deleted in Kitsu are left to full scans
+func (e *engine) scanChanged(ctx context.Context, since string, enqueue func(kitsu.Attachment) bool) (string, error) {
+	mark := since
+	track := func(updatedAt string) {
+		if updatedAt > mark {
+			mark = updatedAt
+		}
+	}
+
+	from := since
+	if t, err := time.Parse(kitsuTime, since); err == nil {
+		from = t.Add(-scanOverlap).Format(kitsuTime)
+	}
+
+	// A page with older objects means the filter had no effect, checked before anything is enqueued
+	unfiltered := func(updatedAt string) bool {
+		return updatedAt != "" && updatedAt < from
+	}
+
+	// Attachments changed themselves
+	seen := map[string]bool{}
+	pager := e.kc.ChangedAttachmentPager(from)
+	for {
+		var page []kitsu.Attachment
+		if !pager.Next(ctx, &page) {
+			break
+		}
+		for _, elem := range page {
+			if unfiltered(elem.UpdatedAt) {
+				return mark, errFilterIgnored
+			}
+		}
+		for _, elem := range page {
+			track(elem.UpdatedAt)
+			if seen[elem.ID] {
+				continue
+			}
+			seen[elem.ID] = true
+			if !enqueue(elem) {
+				return mark, nil
+			}
+		}
+	}
+	if err := pager.Err(); err != nil {
+		return mark, err
+	}
+
+	// Attachments of changed comments
+	var ids []string
+	pager = e.kc.ChangedCommentPager(from)
+	for {
+		var page []kitsu.Comment
+		if !pager.Next(ctx, &page) {
+			break
+		}
+		for _, elem := range page {
+			if unfiltered(elem.UpdatedAt) {
+				return mark, errFilterIgnored
+			}
+			track(elem.UpdatedAt)
+			ids = append(ids, elem.AttachmentFiles...)
+		}
+	}
+	if err := pager.Err(); err != nil {
+		return mark, err
+	}
+
+	// Attachments of changed tasks
+	var taskIDs []string
+	pager = e.kc.ChangedTaskPager(from)
+	for {
+		var page []kitsu.Task
+		if !pager.Next(ctx, &page) {
+			break
+		}
+		for _, elem := range page {
+			if unfiltered(elem.UpdatedAt) {
+				return mark, errFilterIgnored
+			}
+			track(elem.UpdatedAt)
+			taskIDs = append(taskIDs, elem.ID)
+		}
+	}
+	if err := pager.Err(); err != nil {
+		return mark, err
+	}
+	ids = append(ids, model.FindAttachmentIDsByTasks(e.db, taskIDs)...)
+
+	// Attachments interrupted or waiting for retry
+	ids = append(ids, model.FindAttachmentIDsToRetry(e.db, time.Now())...)
+
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		attachment, err := e.fetchAttachment(ctx, id)
+		if kitsu.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return mark, err
+		}
+		if !enqueue(attachment) {
+			return mark, nil
+		}
+	}
+
+	return mark, nil
+}
+
+// fetchAttachment gets a single attachment along with the task of its comment
+func (e *engine) fetchAttachment(ctx context.Context, id string) (kitsu.Attachment, error) {
+	attachment, err := e.kc.GetAttachment(ctx, id)
+	if err != nil {
+		return attachment, err
+	}
+
+	if attachment.Comment.ObjectID == "" && attachment.CommentID != "" {
+		comment, err := e.kc.GetCommentByID(ctx, attachment.CommentID)
+		if err != nil && !kitsu.IsNotFound(err) {
+			return attachment, err
+		}
+		attachment.Comment.ObjectID = comment.ObjectID
+	}
+
+	return attachment, nil
+}
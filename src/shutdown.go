@@ -0,0 +1,56 @@
+package main
+
+import (
+	"app/src/model"
+	"app/src/utils"
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// DefaultShutdownTimeout is used when shutdown_timeout is not set in config
+const DefaultShutdownTimeout = 30 * time.Second
+
+// handleShutdown returns stop context cancelled on SIGTERM/SIGINT and work context cancelled once shutdown_timeout
+// is over or the signal comes again. Nothing new is started after stop, in-flight transfers are aborted after work
+func handleShutdown(conf utils.Config) (context.Context, context.Context) {
+	stop, cancelStop := context.WithCancel(context.Background())
+	work, cancelWork := context.WithCancel(context.Background())
+
+	timeout := time.Duration(conf.Backup.ShutdownTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = DefaultShutdownTimeout
+	}
+
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		sig := <-sigs
+		log.Warn("[shutdown.go][handleShutdown] Received " + sig.String() + ", finishing transfers in progress within " + timeout.String())
+		cancelStop()
+
+		timer := time.NewTimer(timeout)
+		select {
+		case <-timer.C:
+			log.Warn("[shutdown.go][handleShutdown] Shutdown timeout is over, aborting transfers")
+		case sig = <-sigs:
+			timer.Stop()
+			log.Warn("[shutdown.go][handleShutdown] Received " + sig.String() + " again, aborting transfers")
+		}
+		cancelWork()
+	}()
+
+	return stop, work
+}
+
+// finishShutdown leaves no attachment in progress so the next start picks them up
+func finishShutdown(db *gorm.DB) {
+	model.ResetInterruptedAttachments(db)
+	log.Info("[shutdown.go][finishShutdown] Stopped")
+}
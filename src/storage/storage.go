@@ -0,0 +1,89 @@
+// Package storage describes destinations the attachments are backed up to
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrNotFound is returned when the key doesn't exist in the storage
+var ErrNotFound = errors.New("object not found")
+
+// Object describes a single file kept in the storage
+type Object struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+// Storage is implemented by every backup destination, keys are always slash separated
+type Storage interface {
+	// Put streams content under the key, replacing existing one
+	Put(key string, content io.Reader) error
+	// Stat returns object info, ErrNotFound if the key doesn't exist
+	Stat(key string) (Object, error)
+	// List returns every object stored under the given prefix
+	List(prefix string) ([]Object, error)
+	// Get opens the object for reading, caller must close it
+	Get(key string) (io.ReadCloser, error)
+	// Delete removes the object
+	Delete(key string) error
+}
+
+// ContextPutter is implemented by storages able to abort an upload in progress once ctx is done
+type ContextPutter interface {
+	// PutContext streams content under the key, incomplete upload is cleaned up when ctx is done first
+	PutContext(ctx context.Context, key string, content io.Reader) error
+}
+
+// Put streams content under the key until ctx is done. Storages without ContextPutter stop reading content instead
+// and clean up on their own as they do on any read error
+func Put(ctx context.Context, s Storage, key string, content io.Reader) error {
+	if putter, ok := s.(ContextPutter); ok {
+		return putter.PutContext(ctx, key, content)
+	}
+
+	return s.Put(key, &contextReader{ctx: ctx, r: content})
+}
+
+// contextReader fails reads once ctx is done
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// Copier is implemented by storages able to copy objects server side
+type Copier interface {
+	// Copy duplicates the object under a new key, replacing existing one
+	Copy(srcKey, dstKey string) error
+}
+
+// Copy duplicates the object server side when the storage supports it, otherwise streams it through
+func Copy(s Storage, srcKey, dstKey string) error {
+	if copier, ok := s.(Copier); ok {
+		return copier.Copy(srcKey, dstKey)
+	}
+
+	content, err := s.Get(srcKey)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	return s.Put(dstKey, content)
+}
+
+// Destination is a named storage from config
+type Destination struct {
+	Name string
+	Storage
+}
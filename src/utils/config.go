@@ -10,28 +10,119 @@ import (
 type Config struct {
 	Debug bool
 	Kitsu struct {
-		Hostname string
-		Email    string
-		Password string
+		Hostname     string
+		Email        string
+		Password     string
+		PageSize     int
+		Timeout      int
+		CacheTTL     int // minutes, 0 disables metadata cache
+		PersistCache bool
+		EventsURL    string // Socket.IO endpoint, hostname + "socket.io/" when empty
 	}
+	Retry  RetryConfig
 	Backup struct {
-		Threads         int
-		PollDuration    int
-		LocalStorage    string
-		IgnoreExtension []string
-		FastDelete      bool
-		S3              struct {
-			AccessKey        string
-			SecretKey        string
-			BucketName       string
-			Endpoint         string
-			Region           string
-			S3ForcePathStyle bool
-			RootFolderName   string
+		Threads           int // superseded by Workers, used as attachments limit when it's not set
+		PollDuration      int
+		Stream            bool
+		LocalStorage      string
+		IgnoreExtension   []string
+		PathTemplate      string
+		FastDelete        bool
+		DeleteGracePeriod int
+		FailedMaxDelay    int
+		ShutdownTimeout   int
+		FullScanInterval  int // hours, 0 scans everything every time
+		Live              bool
+		Storage           struct {
+			Type string
+			Path string
+		}
+		SFTP         SFTPConfig
+		Azure        AzureConfig
+		GCS          GCSConfig
+		S3           S3Config
+		Destinations []Destination
+		Workers      struct {
+			Attachments int
+			Metadata    int
+			Downloads   int
+			Uploads     int
+		}
+		Retention struct {
+			KeepLast            int
+			KeepDaily           int
+			KeepMonthly         int
+			KeepProjectStatuses []string
 		}
 	}
 }
 
+// RetryConfig holds retry policy for Kitsu and S3 requests, delays are in milliseconds
+type RetryConfig struct {
+	MaxAttempts     int
+	BaseDelay       int
+	MaxDelay        int
+	RetryableStatus []int
+}
+
+// Destination is a named storage every attachment is copied to
+type Destination struct {
+	Name  string
+	Type  string
+	Path  string
+	S3    S3Config
+	SFTP  SFTPConfig
+	Azure AzureConfig
+	GCS   GCSConfig
+}
+
+// S3Config holds S3 compatible bucket used as storage
+type S3Config struct {
+	AccessKey        string
+	SecretKey        string
+	BucketName       string
+	Endpoint         string
+	Region           string
+	S3ForcePathStyle bool
+	RootFolderName   string
+	PartSize         int
+	Concurrency      int
+	MaxConnections   int
+}
+
+// SFTPConfig holds connection to SFTP server used as storage
+type SFTPConfig struct {
+	Host                  string
+	Port                  int
+	User                  string
+	KeyFile               string
+	KnownHosts            string
+	HostKey               string
+	InsecureIgnoreHostKey bool
+	RemoteRoot            string
+}
+
+// AzureConfig holds Azure Blob container used as storage
+type AzureConfig struct {
+	AccountName string
+	AccountKey  string
+	SASToken    string
+	Container   string
+	Endpoint    string
+	AccessTier  string
+	BlockSize   int
+	Concurrency int
+}
+
+// GCSConfig holds Google Cloud Storage bucket used as storage
+type GCSConfig struct {
+	Bucket          string
+	CredentialsFile string
+	StorageClass    string
+	Endpoint        string
+	ChunkSize       int
+}
+
 func ConfRead() Config {
 	path := "conf.toml"
 	if os.Getenv("TEST") == "true" {
@@ -50,3 +141,20 @@ func ConfRead() Config {
 
 	return config
 }
+
+// BackupDestinations returns destinations from config, single [backup.storage] is used when none are listed
+func (c Config) BackupDestinations() []Destination {
+	if len(c.Backup.Destinations) > 0 {
+		return c.Backup.Destinations
+	}
+
+	return []Destination{{
+		Name:  "default",
+		Type:  c.Backup.Storage.Type,
+		Path:  c.Backup.Storage.Path,
+		S3:    c.Backup.S3,
+		SFTP:  c.Backup.SFTP,
+		Azure: c.Backup.Azure,
+		GCS:   c.Backup.GCS,
+	}}
+}
@@ -0,0 +1,11 @@
+package utils
+
+// CountingWriter counts bytes written through it and discards them
+type CountingWriter struct {
+	Count int64
+}
+
+func (w *CountingWriter) Write(p []byte) (int, error) {
+	w.Count += int64(len(p))
+	return len(p), nil
+}
@@ -57,6 +57,6 @@ func DebugHTTPResponse(resp *http.Response, respBody []byte) {
 		fmt.Println("Headers : ", string(prettyResp))
 		fmt.Println("Body : ", string(prettyBody))
 
-		fmt.Println("--end--\n")
+		fmt.Print("--end--\n\n")
 	}
 }
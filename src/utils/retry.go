@@ -0,0 +1,91 @@
+package utils
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// Defaults used when [retry] is missing from config
+const (
+	DefaultMaxAttempts = 5
+	DefaultBaseDelay   = 500 * time.Millisecond
+	DefaultMaxDelay    = 30 * time.Second
+)
+
+// DefaultRetryableStatus lists HTTP statuses worth another attempt
+var DefaultRetryableStatus = []int{429, 500, 502, 503, 504}
+
+// Attempts returns how many times a call is made in total
+func (r RetryConfig) Attempts() int {
+	if r.MaxAttempts <= 0 {
+		return DefaultMaxAttempts
+	}
+	return r.MaxAttempts
+}
+
+// Delays returns base and max delay between attempts
+func (r RetryConfig) Delays() (time.Duration, time.Duration) {
+	base := time.Duration(r.BaseDelay) * time.Millisecond
+	if base <= 0 {
+		base = DefaultBaseDelay
+	}
+	max := time.Duration(r.MaxDelay) * time.Millisecond
+	if max <= 0 {
+		max = DefaultMaxDelay
+	}
+	if max < base {
+		max = base
+	}
+	return base, max
+}
+
+// IsRetryableStatus tells if the HTTP status is in the retryable list
+func (r RetryConfig) IsRetryableStatus(code int) bool {
+	statuses := r.RetryableStatus
+	if len(statuses) == 0 {
+		statuses = DefaultRetryableStatus
+	}
+	for _, elem := range statuses {
+		if elem == code {
+			return true
+		}
+	}
+	return false
+}
+
+// Backoff returns delay before the given attempt (starting from 1 for the first retry),
+// exponential growth capped by max delay with full jitter
+func (r RetryConfig) Backoff(attempt int) time.Duration {
+	base, max := r.Delays()
+
+	delay := max
+	if attempt < 32 {
+		if d := base << uint(attempt-1); d > 0 && d < max {
+			delay = d
+		}
+	}
+
+	return time.Duration(rand.Int63n(int64(delay)) + 1)
+}
+
+// Retry calls fn until it succeeds, retryable says no, attempts run out or ctx is done. The last error is returned
+func Retry(ctx context.Context, policy RetryConfig, retryable func(error) bool, fn func() error) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		if attempt >= policy.Attempts() || !retryable(err) || ctx.Err() != nil {
+			return err
+		}
+
+		timer := time.NewTimer(policy.Backoff(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}